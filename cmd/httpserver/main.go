@@ -3,7 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -13,176 +18,207 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+	"github.com/arnicfil/go_learn_http_protocol/internal/metrics"
 	"github.com/arnicfil/go_learn_http_protocol/internal/request"
 	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/arnicfil/go_learn_http_protocol/internal/router"
 	"github.com/arnicfil/go_learn_http_protocol/internal/server"
 )
 
 const port = 42069
 
-func respond400() []byte {
-	return []byte(`<html>
-  <head>
-    <title>400 Bad Request</title>
-  </head>
-  <body>
-    <h1>Bad Request</h1>
-    <p>Your request honestly kinda sucked.</p>
-  </body>
-</html>`)
+// page is the content of the fixed pages, rendered as HTML, JSON or plain text
+// depending on what the client accepts.
+type page struct {
+	heading string
+	message string
 }
 
-func respond500() []byte {
-	return []byte(`<html>
-  <head>
-    <title>500 Internal Server Error</title>
-  </head>
-  <body>
-    <h1>Internal Server Error</h1>
-    <p>Okay, you know what? This one is on me.</p>
-  </body>
-</html>`)
-}
+var (
+	pageBadRequest    = page{"Bad Request", "Your request honestly kinda sucked."}
+	pageInternalError = page{"Internal Server Error", "Okay, you know what? This one is on me."}
+	pageOK            = page{"Success!", "Your request was an absolute banger."}
+)
 
-func respond200() []byte {
-	return []byte(`<html>
-  <head>
-    <title>200 OK</title>
-  </head>
-  <body>
-    <h1>Success!</h1>
-    <p>Your request was an absolute banger.</p>
-  </body>
-</html>`)
-}
+var pageTypes = []string{"text/html", "application/json", "text/plain"}
 
 func main() {
-	server, err := server.Serve(port, handler)
+	grace := flag.Duration("grace", 10*time.Second, "how long in-flight requests may run on shutdown")
+	certFile := flag.String("cert", "", "PEM certificate file, serves HTTPS together with -key")
+	keyFile := flag.String("key", "", "PEM private key file for -cert")
+	selfSigned := flag.Bool("self-signed", false, "serve HTTPS with a generated certificate for localhost")
+	accessLog := flag.String("access-log", "combined", "access log format on stdout: common, combined, json or off")
+	flag.Parse()
+
+	opts, err := accessLogOptions(*accessLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reg := metrics.New()
+	opts = append(opts, server.WithMetrics(reg))
+
+	rt := router.New()
+	rt.Handle("GET", "/yourproblem", handlePage(response.StatusBadRequest, pageBadRequest))
+	rt.Handle("GET", "/myproblem", handlePage(response.StatusInternalServerError, pageInternalError))
+	rt.Handle("GET", "/httpbin/{path...}", handleChunks)
+	rt.Handle("GET", "/videochunked", handleVideoChunks)
+	rt.Handle("GET", "/video", handleVideo)
+	rt.Handle("GET", "/metrics", reg.Handler())
+	rt.Handle("GET", "/{path...}", handlePage(response.StatusOK, pageOK))
+
+	handler := rt.Handler()
+	addr := fmt.Sprintf(":%d", port)
+
+	var srv *server.Server
+	switch {
+	case *certFile != "" || *keyFile != "":
+		srv, err = server.ListenAndServeTLS(addr, *certFile, *keyFile, handler, opts...)
+	case *selfSigned:
+		var cert tls.Certificate
+		cert, err = server.SelfSignedCert("localhost", "127.0.0.1", "::1")
+		if err == nil {
+			srv, err = server.ListenAndServe(addr, handler, append(opts, server.WithCertificate(cert))...)
+		}
+	default:
+		srv, err = server.ListenAndServe(addr, handler, opts...)
+	}
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+
+	var serr *server.ShutdownError
+	err = srv.Shutdown(ctx)
+	if errors.As(err, &serr) {
+		log.Printf("Server stopped, %d connections cut off after %s", serr.Forced, *grace)
+		return
+	}
+	if err != nil {
+		log.Printf("Error stopping server: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) *server.HandlerError {
-	body := respond200()
-	hdrs := response.GetDefaultHeaders(0)
-	status := response.StatusOK
-	hdrs.Set("Content-Type", "text/html")
-	target := req.RequestLine.RequestTarget
-
-	if strings.Contains(target, "yourproblem") {
-		body = respond400()
-		status = response.StatusBadRequest
-	} else if strings.Contains(target, "myproblem") {
-		body = respond500()
-		status = response.StatusInternalServerError
-	} else if strings.Contains(target, "httpbin") {
-		err := handleChunks(w, req)
-		return err
-	} else if strings.Contains(target, "videochunked") {
-		fmt.Println("Streaming video chunked")
-		err := handleVideoChunks(w)
-		return err
-	} else if strings.Contains(target, "video") {
-		fmt.Println("Streaming video not chunked")
-		err := handleVideo(w)
-		return err
-	}
+func handlePage(status response.StatusCode, p page) server.Handler {
+	return func(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+		contentType, herr := server.Negotiate(req, pageTypes...)
+		if herr != nil {
+			return herr
+		}
 
-	hdrs.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		contentType, body := p.render(status, contentType)
+		hdrs := response.GetDefaultHeaders(len(body))
+		hdrs.Set("Content-Type", contentType)
+		hdrs.Set("Vary", "Accept")
 
-	w.WriteStatusLine(status)
-	w.WriteHeaders(hdrs)
-	w.WriteBody(body)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(hdrs)
+		w.WriteBody(body)
 
-	return nil
+		return nil
+	}
 }
 
-func handleChunks(w *response.Writer, req *request.Request) *server.HandlerError {
-	if !strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		return nil
+// render returns the page as the negotiated media type, along with the
+// Content-Type to send it with. HTML pages carry a charset, as the server's
+// error pages do.
+func (p page) render(status response.StatusCode, mediaType string) (string, []byte) {
+	switch mediaType {
+	case "text/html":
+		return "text/html; charset=utf-8", fmt.Appendf(nil, `<html>
+  <head>
+    <title>%d %s</title>
+  </head>
+  <body>
+    <h1>%s</h1>
+    <p>%s</p>
+  </body>
+</html>`, status, response.StatusText(status), p.heading, p.message)
+	case "application/json":
+		body, _ := json.Marshal(map[string]string{"title": p.heading, "message": p.message})
+		return "application/json", body
 	}
 
-	path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
+	return "text/plain", fmt.Appendf(nil, "%s\n%s\n", p.heading, p.message)
+}
+
+func accessLogOptions(format string) ([]server.Option, error) {
+	switch format {
+	case "common":
+		return []server.Option{server.WithAccessLog(os.Stdout, server.AccessLogCommon)}, nil
+	case "combined":
+		return []server.Option{server.WithAccessLog(os.Stdout, server.AccessLogCombined)}, nil
+	case "json":
+		return []server.Option{server.WithAccessLog(os.Stdout, server.AccessLogJSON)}, nil
+	case "off":
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Error unknown access log format %q", format)
+}
+
+func handleChunks(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+	path := strings.TrimPrefix(req.URL.RequestURI(), "/httpbin")
 	target := "https://httpbin.org" + path
 
-	resp, err := http.Get(target)
+	upstream, err := http.NewRequestWithContext(req.Context(), req.RequestLine.Method, target, nil)
 	if err != nil {
 		return &server.HandlerError{
 			StatusCode: response.StatusInternalServerError,
 			Message:    *bytes.NewBufferString(err.Error()),
 		}
 	}
-	defer resp.Body.Close()
 
-	hdrs := response.GetDefaultHeaders(0)
-	for k, val := range resp.Header {
-		if len(val) > 0 {
-			hdrs.Set(k, val[len(val)-1])
+	resp, err := http.DefaultClient.Do(upstream)
+	if err != nil {
+		return &server.HandlerError{
+			StatusCode: response.StatusInternalServerError,
+			Message:    *bytes.NewBufferString(err.Error()),
 		}
 	}
+	defer resp.Body.Close()
 
-	hdrs.Remove("Content-Length")
-	hdrs.Set("Transfer-Encoding", "chunked")
-	hdrs.Set("Trailer", "X-Content-SHA256")
-	hdrs.Set("Trailer", "X-Content-Length")
-
-	w.WriteStatusLine(response.StatusOK)
-	w.WriteHeaders(hdrs)
-	body := bytes.NewBuffer([]byte{})
-
-	buf := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			body.Write(buf[:n])
-			if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
-				return &server.HandlerError{
-					StatusCode: response.StatusInternalServerError,
-					Message:    *bytes.NewBufferString(err.Error()),
-				}
-			}
+	hdrs := response.GetDefaultHeaders(0)
+	for k, vals := range resp.Header {
+		hdrs.Del(k)
+		for _, val := range vals {
+			hdrs.Add(k, val)
 		}
+	}
 
-		if err == io.EOF {
-			break
-		}
+	return streamChunked(w, hdrs, resp.Body)
+}
 
+func handleVideo(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+	if w.IsHead() {
+		// The size is all HEAD needs, no point reading the whole file.
+		info, err := os.Stat("assets/vim.mp4")
 		if err != nil {
 			return &server.HandlerError{
 				StatusCode: response.StatusInternalServerError,
 				Message:    *bytes.NewBufferString(err.Error()),
 			}
 		}
-	}
 
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		return &server.HandlerError{
-			StatusCode: response.StatusInternalServerError,
-			Message:    *bytes.NewBufferString(err.Error()),
-		}
+		hdrs := response.GetDefaultHeaders(int(info.Size()))
+		hdrs.Set("Content-Type", "video/mp4")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(hdrs)
+		return nil
 	}
 
-	hash := sha256.Sum256(body.Bytes())
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", fmt.Sprintf("%X", hash))
-	trailers.Set("X-Content-Length", strconv.Itoa(body.Len()))
-	w.WriteTrailers(trailers)
-
-	return nil
-}
-
-func handleVideo(w *response.Writer) *server.HandlerError {
 	video, err := os.ReadFile("assets/vim.mp4")
 	if err != nil {
 		return &server.HandlerError{
@@ -194,8 +230,8 @@ func handleVideo(w *response.Writer) *server.HandlerError {
 	hdrs := response.GetDefaultHeaders(len(video))
 
 	hdrs.Set("Content-Type", "video/mp4")
-	hdrs.Set("Trailer", "X-Content-SHA256")
-	hdrs.Set("Trailer", "X-Content-Length")
+	hdrs.Add("Trailer", "X-Content-SHA256")
+	hdrs.Add("Trailer", "X-Content-Length")
 
 	w.WriteStatusLine(response.StatusOK)
 	w.WriteHeaders(hdrs)
@@ -210,7 +246,7 @@ func handleVideo(w *response.Writer) *server.HandlerError {
 	return nil
 }
 
-func handleVideoChunks(w *response.Writer) *server.HandlerError {
+func handleVideoChunks(w response.ResponseWriter, req *request.Request) *server.HandlerError {
 	file, err := os.Open("assets/vim.mp4")
 	if err != nil {
 		return &server.HandlerError{
@@ -218,25 +254,32 @@ func handleVideoChunks(w *response.Writer) *server.HandlerError {
 			Message:    *bytes.NewBufferString(err.Error()),
 		}
 	}
+	defer file.Close()
 
-	hdrs := response.GetDefaultHeaders(0)
+	return streamChunked(w, response.GetDefaultHeaders(0), bufio.NewReader(file))
+}
 
-	hdrs.Remove("Content-Length")
+// streamChunked forwards src as a chunked body, one chunk per read, and ends
+// it with the SHA256 and length of everything sent as trailers.
+func streamChunked(w response.ResponseWriter, hdrs *headers.Headers, src io.Reader) *server.HandlerError {
+	hdrs.Del("Content-Length")
 	hdrs.Set("Transfer-Encoding", "chunked")
-	hdrs.Set("Trailer", "X-Content-SHA256")
-	hdrs.Set("Trailer", "X-Content-Length")
+	hdrs.Add("Trailer", "X-Content-SHA256")
+	hdrs.Add("Trailer", "X-Content-Length")
 
 	w.WriteStatusLine(response.StatusOK)
 	w.WriteHeaders(hdrs)
+	if w.IsHead() {
+		// HEAD gets the same headers but no body, so don't read src at all.
+		return nil
+	}
 
-	reader := bufio.NewReader(file)
+	hash := sha256.New()
 	buf := make([]byte, 1024)
-	body := bytes.NewBuffer([]byte{})
-
 	for {
-		n, err := reader.Read(buf)
+		n, err := src.Read(buf)
 		if n > 0 {
-			body.Write(buf[:n])
+			hash.Write(buf[:n])
 			if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
 				return &server.HandlerError{
 					StatusCode: response.StatusInternalServerError,
@@ -257,7 +300,7 @@ func handleVideoChunks(w *response.Writer) *server.HandlerError {
 		}
 	}
 
-	_, err = w.WriteChunkedBodyDone()
+	_, err := w.WriteChunkedBodyDone()
 	if err != nil {
 		return &server.HandlerError{
 			StatusCode: response.StatusInternalServerError,
@@ -265,10 +308,9 @@ func handleVideoChunks(w *response.Writer) *server.HandlerError {
 		}
 	}
 
-	hash := sha256.Sum256(body.Bytes())
 	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", fmt.Sprintf("%X", hash))
-	trailers.Set("X-Content-Length", strconv.Itoa(body.Len()))
+	trailers.Set("X-Content-SHA256", fmt.Sprintf("%X", hash.Sum(nil)))
+	trailers.Set("X-Content-Length", strconv.Itoa(w.BytesWritten()))
 	w.WriteTrailers(trailers)
 
 	return nil
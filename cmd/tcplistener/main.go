@@ -37,7 +37,7 @@ func main() {
 		fmt.Printf("- Target: %v\n", req.RequestLine.RequestTarget)
 		fmt.Printf("- Version: %v\n", req.RequestLine.HttpVersion)
 		fmt.Println("Headers: ")
-		for key, val := range req.Headers {
+		for key, val := range req.Headers.All() {
 			fmt.Printf("- %s: %s\n", key, val)
 		}
 		fmt.Println("Body:")
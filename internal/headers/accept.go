@@ -0,0 +1,215 @@
+package headers
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// AcceptRange is one element of an Accept, Accept-Language or
+// Accept-Encoding field: a media range, language range or coding, with its
+// weight and, for media ranges, any other parameters.
+type AcceptRange struct {
+	Value  string
+	Params map[string]string
+	Q      float64
+}
+
+// ParseAccept splits an Accept* field value into its elements, in the order
+// they were sent. Values and parameter names are lowercased, and elements
+// with an invalid weight are dropped.
+func ParseAccept(val string) []AcceptRange {
+	var ranges []AcceptRange
+	for _, element := range strings.Split(val, ",") {
+		parts := strings.Split(element, ";")
+		value := strings.ToLower(strings.Trim(parts[0], " \t"))
+		if value == "" {
+			continue
+		}
+
+		accept := AcceptRange{Value: value, Q: 1}
+		valid := true
+		for _, param := range parts[1:] {
+			key, paramVal, _ := strings.Cut(param, "=")
+			key = strings.ToLower(strings.Trim(key, " \t"))
+			paramVal = strings.Trim(strings.Trim(paramVal, " \t"), `"`)
+			if key == "" {
+				continue
+			}
+
+			// Parameters after the weight are extensions and are ignored.
+			if key == "q" {
+				accept.Q, valid = parseQ(paramVal)
+				break
+			}
+
+			if accept.Params == nil {
+				accept.Params = make(map[string]string)
+			}
+			accept.Params[key] = paramVal
+		}
+
+		if valid {
+			ranges = append(ranges, accept)
+		}
+	}
+
+	return ranges
+}
+
+// parseQ parses a weight, which is between 0 and 1 with at most three
+// decimals (RFC 9110, section 12.4.2).
+func parseQ(val string) (float64, bool) {
+	whole, decimals, _ := strings.Cut(val, ".")
+	if (whole != "0" && whole != "1") || len(decimals) > 3 || strings.Trim(decimals, "0123456789") != "" {
+		return 0, false
+	}
+	if whole == "1" && strings.Trim(decimals, "0") != "" {
+		return 0, false
+	}
+
+	q, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return q, true
+}
+
+func (h *Headers) Accept() []AcceptRange {
+	return h.acceptRanges("Accept")
+}
+
+func (h *Headers) AcceptLanguage() []AcceptRange {
+	return h.acceptRanges("Accept-Language")
+}
+
+func (h *Headers) AcceptEncoding() []AcceptRange {
+	return h.acceptRanges("Accept-Encoding")
+}
+
+func (h *Headers) acceptRanges(key string) []AcceptRange {
+	return ParseAccept(strings.Join(h.Values(key), ","))
+}
+
+// Negotiate returns the media type in offers the client prefers according to
+// its Accept field. Each offer takes the weight of the most specific range
+// that matches it, so with "text/*;q=0.5, text/html" text/html is preferred
+// over text/plain, and ties go to the earlier offer. Without an Accept field
+// the first offer is returned, and "" means the client accepts none of them
+// and should get a 406.
+func (h *Headers) Negotiate(offers []string) string {
+	ranges := h.Accept()
+	if len(ranges) == 0 {
+		return first(offers)
+	}
+
+	return negotiate(ranges, offers, matchMediaRange, 0)
+}
+
+// NegotiateLanguage is Negotiate for Accept-Language. A range matches a tag
+// that equals it or starts with it followed by "-", so "en" matches "en-GB".
+func (h *Headers) NegotiateLanguage(offers []string) string {
+	ranges := h.AcceptLanguage()
+	if len(ranges) == 0 {
+		return first(offers)
+	}
+
+	return negotiate(ranges, offers, matchLanguageRange, 0)
+}
+
+// NegotiateEncoding is Negotiate for Accept-Encoding. "identity" is
+// acceptable unless it, or "*", is given a weight of 0, even when the field
+// is empty.
+func (h *Headers) NegotiateEncoding(offers []string) string {
+	if len(h.Values("Accept-Encoding")) == 0 {
+		return first(offers)
+	}
+
+	return negotiate(h.AcceptEncoding(), offers, matchCoding, 1)
+}
+
+// negotiate weighs every offer by the most specific range that matches it.
+// match returns -1 for no match and a larger number the more specific the
+// range is. identityQ is the weight of "identity" when no range names it.
+func negotiate(ranges []AcceptRange, offers []string, match func(AcceptRange, string) int, identityQ float64) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		if strings.EqualFold(offer, "identity") {
+			q = identityQ
+		}
+
+		for _, accept := range ranges {
+			if s := match(accept, offer); s > specificity {
+				q, specificity = accept.Q, s
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+func matchMediaRange(accept AcceptRange, offer string) int {
+	mediaType, params, err := mime.ParseMediaType(offer)
+	if err != nil {
+		return -1
+	}
+	offerType, offerSub, _ := strings.Cut(mediaType, "/")
+	acceptType, acceptSub, _ := strings.Cut(accept.Value, "/")
+
+	specificity := 0
+	switch {
+	case accept.Value == "*" || accept.Value == "*/*":
+	case acceptType == offerType && acceptSub == "*":
+		specificity = 1
+	case acceptType == offerType && acceptSub == offerSub:
+		specificity = 2
+	default:
+		return -1
+	}
+
+	for key, val := range accept.Params {
+		if !strings.EqualFold(params[key], val) {
+			return -1
+		}
+	}
+
+	// Parameters only break ties between ranges of the same kind.
+	return specificity*10 + len(accept.Params)
+}
+
+func matchLanguageRange(accept AcceptRange, offer string) int {
+	offer = strings.ToLower(offer)
+	switch {
+	case accept.Value == "*":
+		return 0
+	case offer == accept.Value, strings.HasPrefix(offer, accept.Value+"-"):
+		return len(accept.Value)
+	}
+
+	return -1
+}
+
+func matchCoding(accept AcceptRange, offer string) int {
+	switch {
+	case accept.Value == "*":
+		return 0
+	case strings.EqualFold(offer, accept.Value):
+		return 1
+	}
+
+	return -1
+}
+
+func first(offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+
+	return offers[0]
+}
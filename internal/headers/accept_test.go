@@ -0,0 +1,104 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccept(t *testing.T) {
+	// Test: Weights, parameters and wildcards
+	ranges := ParseAccept(`Text/HTML, application/json;q=0.9, text/plain; Format=flowed ;q=0.5;ext=1, */*;q=0`)
+	assert.Equal(t, []AcceptRange{
+		{Value: "text/html", Q: 1},
+		{Value: "application/json", Q: 0.9},
+		{Value: "text/plain", Params: map[string]string{"format": "flowed"}, Q: 0.5},
+		{Value: "*/*", Q: 0},
+	}, ranges)
+
+	// Test: Empty elements and invalid weights are dropped
+	ranges = ParseAccept(" , gzip;q=1.5, br;q=0.8000, deflate;q=abc, identity;q=0.25")
+	assert.Equal(t, []AcceptRange{{Value: "identity", Q: 0.25}}, ranges)
+
+	// Test: Repeated fields are combined
+	headers := NewHeaders()
+	headers.Add("Accept-Language", "fr")
+	headers.Add("Accept-Language", "en;q=0.5")
+	assert.Equal(t, []AcceptRange{{Value: "fr", Q: 1}, {Value: "en", Q: 0.5}}, headers.AcceptLanguage())
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain"}
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"", "text/html"},
+		{"application/json", "application/json"},
+		{"*/*", "text/html"},
+		{"text/*", "text/html"},
+		{"text/*;q=0.5, text/plain", "text/plain"},
+		{"text/html;q=0.1, application/json;q=0.2", "application/json"},
+		{"application/json;q=0.5, text/plain;q=0.5", "application/json"},
+		{"*/*;q=0.1, text/html;q=0", "application/json"},
+		{"text/plain;charset=utf-8, text/html;q=0.5", "text/html"},
+		{"image/png", ""},
+		{"*/*;q=0", ""},
+	}
+	for _, c := range cases {
+		headers := NewHeaders()
+		if c.accept != "" {
+			headers.Set("Accept", c.accept)
+		}
+		assert.Equal(t, c.want, headers.Negotiate(offers), c.accept)
+	}
+
+	// Test: Parameters on a range must match the offer
+	headers := NewHeaders()
+	headers.Set("Accept", "text/plain;charset=utf-8;q=1, text/plain;q=0.1")
+	assert.Equal(t, "text/plain; charset=utf-8", headers.Negotiate([]string{"text/plain", "text/plain; charset=utf-8"}))
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	offers := []string{"en-US", "en-GB", "de"}
+
+	// Test: Prefix matches a longer tag
+	headers := NewHeaders()
+	headers.Set("Accept-Language", "de;q=0.5, en")
+	assert.Equal(t, "en-US", headers.NegotiateLanguage(offers))
+
+	// Test: More specific range wins over a prefix
+	headers.Set("Accept-Language", "en-gb, en;q=0.8, *;q=0.1")
+	assert.Equal(t, "en-GB", headers.NegotiateLanguage(offers))
+
+	// Test: Prefix only matches whole subtags
+	headers.Set("Accept-Language", "e, fr")
+	assert.Equal(t, "", headers.NegotiateLanguage(offers))
+
+	// Test: Missing field accepts anything
+	headers = NewHeaders()
+	assert.Equal(t, "en-US", headers.NegotiateLanguage(offers))
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	offers := []string{"br", "gzip", "identity"}
+
+	// Test: Explicit weights
+	headers := NewHeaders()
+	headers.Set("Accept-Encoding", "gzip, br;q=0.5")
+	assert.Equal(t, "gzip", headers.NegotiateEncoding(offers))
+
+	// Test: Identity is acceptable unless excluded
+	headers.Set("Accept-Encoding", "")
+	assert.Equal(t, "identity", headers.NegotiateEncoding(offers))
+	headers.Set("Accept-Encoding", "deflate")
+	assert.Equal(t, "identity", headers.NegotiateEncoding(offers))
+	headers.Set("Accept-Encoding", "deflate, *;q=0")
+	assert.Equal(t, "", headers.NegotiateEncoding(offers))
+	headers.Set("Accept-Encoding", "identity;q=0")
+	assert.Equal(t, "", headers.NegotiateEncoding(offers))
+
+	// Test: Wildcard covers codings not listed
+	headers.Set("Accept-Encoding", "br;q=0, *")
+	assert.Equal(t, "gzip", headers.NegotiateEncoding(offers))
+}
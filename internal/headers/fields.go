@@ -0,0 +1,118 @@
+package headers
+
+import (
+	"errors"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate format every HTTP date is sent in.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// timeFormats are the formats a received date may use: IMF-fixdate and the
+// obsolete RFC 850 and asctime formats (RFC 9110, section 5.6.7).
+var timeFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+var ERROR_INVALID_CONTENT_LENGTH = errors.New("Error content length is invalid")
+var ERROR_DUPLICATE_CONTENT_LENGTH = errors.New("Error content length is given more than once")
+var ERROR_INVALID_DATE = errors.New("Error date is not in a recognized format")
+
+// ContentLength returns the single Content-Length. A repeated field or a list
+// value is rejected even when every length agrees, as is anything but plain
+// digits, such as "+5", since senders that disagree on the length of a
+// message can be used to smuggle another one inside it.
+func (h *Headers) ContentLength() (int64, bool, error) {
+	values := h.Values("Content-Length")
+	switch {
+	case len(values) == 0:
+		return 0, false, nil
+	case len(values) > 1, strings.Contains(values[0], ","):
+		return 0, false, ERROR_DUPLICATE_CONTENT_LENGTH
+	}
+
+	val := values[0]
+	if val == "" || strings.Trim(val, "0123456789") != "" {
+		return 0, false, ERROR_INVALID_CONTENT_LENGTH
+	}
+
+	length, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, false, ERROR_INVALID_CONTENT_LENGTH
+	}
+
+	return length, true, nil
+}
+
+// ContentType returns the lowercased media type and its parameters, e.g.
+// "text/html" and {"charset": "utf-8"}. The media type is empty if the field
+// is missing or malformed, params is nil if the parameters are.
+func (h *Headers) ContentType() (mediaType string, params map[string]string) {
+	val, ok := h.Get("Content-Type")
+	if !ok {
+		return "", nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(val)
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+		return "", nil
+	}
+
+	return mediaType, params
+}
+
+// Time parses the date in the field key, accepting any of the formats in
+// RFC 9110. The result is in UTC.
+func (h *Headers) Time(key string) (time.Time, bool, error) {
+	val, ok := h.Get(key)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	t, err := ParseTime(val)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return t, true, nil
+}
+
+func (h *Headers) Date() (time.Time, bool, error) {
+	return h.Time("Date")
+}
+
+func (h *Headers) LastModified() (time.Time, bool, error) {
+	return h.Time("Last-Modified")
+}
+
+func (h *Headers) IfModifiedSince() (time.Time, bool, error) {
+	return h.Time("If-Modified-Since")
+}
+
+// SetDate sets the Date field to t in IMF-fixdate.
+func (h *Headers) SetDate(t time.Time) {
+	h.Set("Date", FormatTime(t))
+}
+
+// FormatTime formats t in IMF-fixdate, the format dates are sent in.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseTime parses an HTTP date in any of the formats in RFC 9110.
+func ParseTime(val string) (time.Time, error) {
+	val = strings.Trim(val, " \t")
+	for _, format := range timeFormats {
+		t, err := time.Parse(format, val)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, ERROR_INVALID_DATE
+}
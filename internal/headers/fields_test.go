@@ -0,0 +1,107 @@
+package headers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentLength(t *testing.T) {
+	// Test: Missing field
+	headers := NewHeaders()
+	length, ok, err := headers.ContentLength()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), length)
+
+	// Test: Valid length
+	headers.Set("Content-Length", "42")
+	length, ok, err = headers.ContentLength()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), length)
+
+	// Test: Invalid lengths
+	for _, val := range []string{"", "ten", "+5", "-1", " 5", "99999999999999999999"} {
+		headers.Set("Content-Length", val)
+		_, ok, err = headers.ContentLength()
+		require.ErrorIs(t, err, ERROR_INVALID_CONTENT_LENGTH, val)
+		assert.False(t, ok)
+	}
+
+	// Test: Repeated field and list value
+	headers.Set("Content-Length", "5")
+	headers.Add("Content-Length", "5")
+	_, _, err = headers.ContentLength()
+	require.ErrorIs(t, err, ERROR_DUPLICATE_CONTENT_LENGTH)
+	headers.Set("Content-Length", "5, 5")
+	_, _, err = headers.ContentLength()
+	require.ErrorIs(t, err, ERROR_DUPLICATE_CONTENT_LENGTH)
+}
+
+func TestContentType(t *testing.T) {
+	// Test: Missing field
+	headers := NewHeaders()
+	mediaType, params := headers.ContentType()
+	assert.Equal(t, "", mediaType)
+	assert.Nil(t, params)
+
+	// Test: Media type is lowercased, quoted parameters are unquoted
+	headers.Set("Content-Type", `Text/HTML; Charset="utf-8"`)
+	mediaType, params = headers.ContentType()
+	assert.Equal(t, "text/html", mediaType)
+	assert.Equal(t, map[string]string{"charset": "utf-8"}, params)
+
+	// Test: Malformed parameters keep the media type
+	headers.Set("Content-Type", "text/plain; charset")
+	mediaType, params = headers.ContentType()
+	assert.Equal(t, "text/plain", mediaType)
+	assert.Nil(t, params)
+
+	// Test: Malformed media type
+	headers.Set("Content-Type", "text/")
+	mediaType, _ = headers.ContentType()
+	assert.Equal(t, "", mediaType)
+}
+
+func TestTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	// Test: IMF-fixdate and the two obsolete formats
+	for _, val := range []string{"Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994"} {
+		got, err := ParseTime(val)
+		require.NoError(t, err, val)
+		assert.True(t, want.Equal(got), val)
+		assert.Equal(t, time.UTC, got.Location())
+	}
+
+	// Test: Unknown format
+	_, err := ParseTime("1994-11-06T08:49:37Z")
+	require.ErrorIs(t, err, ERROR_INVALID_DATE)
+
+	// Test: Named fields
+	headers := NewHeaders()
+	headers.Set("Last-Modified", "Sun, 06 Nov 1994 08:49:37 GMT")
+	headers.Set("If-Modified-Since", "yesterday")
+	got, ok, err := headers.LastModified()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, want.Equal(got))
+	_, ok, err = headers.IfModifiedSince()
+	require.ErrorIs(t, err, ERROR_INVALID_DATE)
+	assert.False(t, ok)
+	_, ok, err = headers.Date()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Test: SetDate writes IMF-fixdate in GMT
+	headers.SetDate(want.In(time.FixedZone("CET", 3600)))
+	val, _ := headers.Get("Date")
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", val)
+	got, ok, err = headers.Date()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, want.Equal(got))
+}
@@ -2,26 +2,70 @@ package headers
 
 import (
 	"errors"
+	"fmt"
+	"iter"
 	"strings"
 	"unicode"
 )
 
-type Headers map[string]string
+// Headers is an ordered list of header fields. Names are matched without
+// regard to case but keep the casing they were added with, and a name can
+// appear any number of times, as Set-Cookie has to. A nil *Headers reads as
+// empty.
+type Headers struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
 
 const clrf = "\r\n"
 
 var ERROR_MALFORMED = errors.New("Error headers are malformed")
 var ERROR_INVALID_HEADER_FORMAT = errors.New("Error invalid error format")
+var ERROR_INVALID_VALUE = errors.New("Error header value contains CR, LF or NUL")
+var ERROR_OBS_FOLD = errors.New("Error header value uses obsolete line folding")
+
+// FieldError reports a field that can't be accepted or sent as it is. Err is
+// ERROR_INVALID_HEADER_FORMAT for a bad name and ERROR_INVALID_VALUE or
+// ERROR_OBS_FOLD for a bad value.
+type FieldError struct {
+	Name  string
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %q: %q", e.Err, e.Name, e.Value)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
 
-func NewHeaders() Headers {
-	return make(map[string]string)
+// Parse reads one field line from data. A line that starts with whitespace
+// after an earlier field is obsolete line folding and is rejected with
+// ERROR_OBS_FOLD; ParseUnfold accepts it instead. Before the first field
+// there is nothing to fold into, so such a line is always rejected with
+// ERROR_INVALID_HEADER_FORMAT: a recipient that skipped it would see
+// different fields (RFC 9112, section 2.2).
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false)
 }
 
-func trimLeftSpace(s string) string {
-	return strings.TrimLeftFunc(s, unicode.IsSpace)
+// ParseUnfold is Parse, except that a folded line is joined to the value of
+// the field before it with a single space.
+func (h *Headers) ParseUnfold(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true)
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) parse(data []byte, unfold bool) (n int, done bool, err error) {
 	sData := string(data)
 	if !strings.Contains(sData, clrf) {
 		return 0, false, nil
@@ -32,46 +76,154 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	line := strings.Split(sData, clrf)[0]
 	bytesConsumed := len(line) + 2
 
+	if line[0] == ' ' || line[0] == '\t' {
+		if h.Len() == 0 {
+			return 0, false, ERROR_INVALID_HEADER_FORMAT
+		}
+
+		last := &h.fields[len(h.fields)-1]
+		if !unfold {
+			return 0, false, &FieldError{Name: last.name, Value: line, Err: ERROR_OBS_FOLD}
+		}
+
+		continuation := strings.Trim(line, " \t")
+		if !ValidValue(continuation) {
+			return 0, false, &FieldError{Name: last.name, Value: continuation, Err: ERROR_INVALID_VALUE}
+		}
+		if continuation != "" {
+			last.value = strings.TrimLeft(last.value+" "+continuation, " ")
+		}
+
+		return bytesConsumed, false, nil
+	}
+
 	parts := strings.SplitN(line, ":", 2)
 	if len(parts) != 2 {
 		return 0, false, ERROR_MALFORMED
 	}
 
-	headerName := strings.ToLower(trimLeftSpace(parts[0]))
-	headerValue := strings.TrimSpace(parts[1])
+	headerName := parts[0]
+	headerValue := strings.Trim(parts[1], " \t")
 
-	if unicode.IsSpace(rune(headerName[len(headerName)-1])) || !validateHeaderName(headerName) {
+	if headerName == "" || unicode.IsSpace(rune(headerName[len(headerName)-1])) || !validateHeaderName(headerName) {
 		return 0, false, ERROR_INVALID_HEADER_FORMAT
 	}
-
-	val, ok := h[headerName]
-	if ok {
-		headerValue = val + ", " + headerValue
+	if !ValidValue(headerValue) {
+		return 0, false, &FieldError{Name: headerName, Value: headerValue, Err: ERROR_INVALID_VALUE}
 	}
 
-	h[headerName] = headerValue
+	h.Add(headerName, headerValue)
 
 	return bytesConsumed, false, nil
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	lowerKey := strings.ToLower(key)
-	val, ok := h[lowerKey]
-	return val, ok
+// Get returns every value of key joined with ", ", the way a list-valued
+// field may be combined. Use Values for fields like Set-Cookie that can't.
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+
+	return strings.Join(values, ", "), true
 }
 
-func (h Headers) Set(key string, val string) {
-	lowerKey := strings.ToLower(key)
-	headerVal, ok := h[lowerKey]
-	if ok {
-		val = headerVal + ", " + val
+// Values returns the values of key in the order they were added.
+func (h *Headers) Values(key string) []string {
+	if h == nil {
+		return nil
+	}
+
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			values = append(values, f.value)
+		}
 	}
 
-	h[lowerKey] = val
+	return values
 }
 
-func (h Headers) Remove(key string) {
-	delete(h, strings.ToLower(key))
+// Add appends a field, keeping any earlier ones with the same name.
+func (h *Headers) Add(key string, val string) {
+	h.fields = append(h.fields, field{name: key, value: val})
+}
+
+// Set replaces every field named key with a single one, in the place of the
+// first, or appends it if there was none.
+func (h *Headers) Set(key string, val string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			h.fields[i] = field{name: key, value: val}
+			h.fields = append(h.fields[:i+1], deleteFields(h.fields[i+1:], key)...)
+			return
+		}
+	}
+
+	h.Add(key, val)
+}
+
+// Del removes every field named key.
+func (h *Headers) Del(key string) {
+	h.fields = deleteFields(h.fields, key)
+}
+
+// Len returns the number of fields, counting repeated names separately.
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+
+	return len(h.fields)
+}
+
+// All yields every field with its original name casing, in order.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+
+		for _, f := range h.fields {
+			if !yield(f.name, f.value) {
+				return
+			}
+		}
+	}
+}
+
+// Validate checks every field before it is written, so a value copied from
+// a request or an upstream response can't end the header block early or add
+// fields of its own. It returns a *FieldError for the first bad field.
+func (h *Headers) Validate() error {
+	for name, val := range h.All() {
+		if name == "" || !validateHeaderName(name) {
+			return &FieldError{Name: name, Value: val, Err: ERROR_INVALID_HEADER_FORMAT}
+		}
+		if !ValidValue(val) {
+			return &FieldError{Name: name, Value: val, Err: ERROR_INVALID_VALUE}
+		}
+	}
+
+	return nil
+}
+
+// ValidValue reports whether val can be sent as a field value. RFC 9110
+// forbids CR, LF and NUL outright; other control characters are let through
+// as recipients are allowed to keep them.
+func ValidValue(val string) bool {
+	return !strings.ContainsAny(val, "\r\n\x00")
+}
+
+func deleteFields(fields []field, key string) []field {
+	kept := fields[:0]
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, key) {
+			kept = append(kept, f)
+		}
+	}
+
+	return kept
 }
 
 func validateHeaderName(s string) bool {
@@ -14,7 +14,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -26,16 +26,26 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
-	// Test: Valid single header with extra whitespace
+	// Test: Valid single header with extra whitespace around the value
 	headers = NewHeaders()
-	data = []byte("     Host: localhost:42069     \r\n\r\n")
+	data = []byte("Host:     localhost:42069     \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, 33, n)
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, 32, n)
 	assert.False(t, done)
 
+	// Test: Whitespace before the first field, even when unfolding
+	headers = NewHeaders()
+	data = []byte("     Host: localhost:42069\r\n\r\n")
+	n, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ERROR_INVALID_HEADER_FORMAT)
+	assert.Equal(t, 0, n)
+	_, _, err = headers.ParseUnfold([]byte("\tHost: localhost:42069\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_HEADER_FORMAT)
+	assert.Equal(t, 0, headers.Len())
+
 	// Test: Valid 2 headers with existing headers
 	headers = NewHeaders()
 	data = []byte("Host: localhost:42069\r\nElse:whatever\r\n\r\n")
@@ -48,8 +58,8 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 15, n)
 	assert.False(t, done)
 
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "whatever", headers["else"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, []string{"whatever"}, headers.Values("else"))
 
 	// Test: Valid Done
 	headers = NewHeaders()
@@ -80,5 +90,108 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 15, n)
 	assert.False(t, done)
 
-	assert.Equal(t, "localhost:42069, another", headers["host"])
+	assert.Equal(t, []string{"localhost:42069", "another"}, headers.Values("host"))
+}
+
+func TestHeadersFields(t *testing.T) {
+	// Test: Parse keeps the original casing and order
+	headers := NewHeaders()
+	data := []byte("X-Custom: 1\r\nset-cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n")
+	for {
+		n, done, err := headers.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	var names []string
+	for name := range headers.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"X-Custom", "set-cookie", "Set-Cookie"}, names)
+	assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("SET-COOKIE"))
+	val, ok := headers.Get("set-cookie")
+	assert.True(t, ok)
+	assert.Equal(t, "a=1, b=2", val)
+
+	// Test: Set replaces every field in place of the first
+	headers = NewHeaders()
+	headers.Add("Vary", "Accept")
+	headers.Add("Content-Type", "text/plain")
+	headers.Add("vary", "Origin")
+	headers.Set("VARY", "*")
+	assert.Equal(t, 2, headers.Len())
+	names = nil
+	for name, val := range headers.All() {
+		names = append(names, name+": "+val)
+	}
+	assert.Equal(t, []string{"VARY: *", "Content-Type: text/plain"}, names)
+
+	// Test: Del removes every field with the name
+	headers.Add("Vary", "Origin")
+	headers.Del("vary")
+	assert.Nil(t, headers.Values("Vary"))
+	assert.Equal(t, 1, headers.Len())
+
+	// Test: Missing field
+	val, ok = headers.Get("Host")
+	assert.False(t, ok)
+	assert.Equal(t, "", val)
+
+	// Test: Nil headers read as empty
+	var empty *Headers
+	assert.Equal(t, 0, empty.Len())
+	assert.Nil(t, empty.Values("Host"))
+	for range empty.All() {
+		t.Fatal("nil headers yielded a field")
+	}
+}
+
+func TestHeadersValues(t *testing.T) {
+	// Test: CR, LF and NUL are rejected
+	for _, line := range []string{"X-Name: a\rb\r\n", "X-Name: a\nb\r\n", "X-Name: a\x00b\r\n"} {
+		headers := NewHeaders()
+		n, _, err := headers.Parse([]byte(line))
+		require.ErrorIs(t, err, ERROR_INVALID_VALUE, line)
+		var ferr *FieldError
+		require.ErrorAs(t, err, &ferr)
+		assert.Equal(t, "X-Name", ferr.Name)
+		assert.Equal(t, 0, n)
+	}
+
+	// Test: Other control characters and obs-text are kept
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("X-Name: a\tb\x01\xe9\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a\tb\x01\xe9"}, headers.Values("X-Name"))
+
+	// Test: Obsolete line folding is rejected
+	headers = NewHeaders()
+	data := []byte("X-Name: a\r\n b\r\n\r\n")
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.ErrorIs(t, err, ERROR_OBS_FOLD)
+
+	// Test: Obsolete line folding is unfolded on request
+	headers = NewHeaders()
+	n, _, err = headers.ParseUnfold(data)
+	require.NoError(t, err)
+	m, done, err := headers.ParseUnfold(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, 4, m)
+	assert.False(t, done)
+	assert.Equal(t, []string{"a b"}, headers.Values("X-Name"))
+	assert.Equal(t, 1, headers.Len())
+
+	// Test: Validate checks names and values set in code
+	headers = NewHeaders()
+	headers.Set("Location", "/ok")
+	require.NoError(t, headers.Validate())
+	headers.Add("Location", "/next\r\nSet-Cookie: a=1")
+	require.ErrorIs(t, headers.Validate(), ERROR_INVALID_VALUE)
+	headers = NewHeaders()
+	headers.Set("Bad Name", "x")
+	require.ErrorIs(t, headers.Validate(), ERROR_INVALID_HEADER_FORMAT)
 }
@@ -0,0 +1,232 @@
+// Package metrics counts what a server.Server does and renders the counts in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/arnicfil/go_learn_http_protocol/internal/server"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the request
+// duration histogram.
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// parseErrorTypes names the parse errors by the sentinel they wrap, for the
+// type label. The first match wins, so the more specific errors come first.
+var parseErrorTypes = []struct {
+	err  error
+	name string
+}{
+	{os.ErrDeadlineExceeded, "timeout"},
+	{request.ERROR_REQUEST_LINE_TOO_LONG, "request_line_too_long"},
+	{request.ERROR_HEADERS_TOO_LARGE, "headers_too_large"},
+	{request.ERROR_TOO_MANY_HEADERS, "too_many_headers"},
+	{request.ERROR_BODY_TOO_LARGE, "body_too_large"},
+	{request.ERROR_METHOD_NOT_IMPLEMENTED, "method_not_implemented"},
+	{request.ERROR_INVALID_METHOD, "invalid_method"},
+	{request.ERROR_UNSUPPORTED_VERSION, "unsupported_version"},
+	{request.ERROR_EXPECTATION_FAILED, "expectation_failed"},
+	{request.ERROR_INVALID_TARGET, "invalid_target"},
+	{request.ERROR_UNSAFE_ENCODING, "unsafe_encoding"},
+	{request.ERROR_MALFORMED_REQUEST_LINE, "malformed_request_line"},
+	{request.ERROR_MALFORMED_HEADER, "malformed_header"},
+	{request.ERROR_DUPLICATE_CONTENT_LENGTH, "duplicate_content_length"},
+	{request.ERROR_AMBIGUOUS_FRAMING, "ambiguous_framing"},
+	{request.ERROR_CHUNKED_NOT_FINAL, "chunked_not_final"},
+	{request.ERROR_UNSUPPORTED_TRANSFER_CODING, "unsupported_transfer_coding"},
+	{request.ERROR_INVALID_CONTENT_LENGTH, "invalid_content_length"},
+	{request.ERROR_MALFORMED_CHUNK, "malformed_chunk"},
+	{request.ERROR_BODY_LENGTH_MISMATCH, "body_length_mismatch"},
+	{request.ERROR_INCOMPLETE_REQUEST, "incomplete_request"},
+}
+
+// Registry implements server.MetricsRecorder. Its zero value is not usable,
+// use New.
+type Registry struct {
+	connsAccepted atomic.Int64
+	connsActive   atomic.Int64
+	inFlight      atomic.Int64
+	bytesRead     atomic.Int64
+	bytesWritten  atomic.Int64
+
+	mu          sync.Mutex
+	requests    map[requestKey]int64
+	parseErrors map[string]int64
+	durations   histogram
+}
+
+type requestKey struct {
+	method      string
+	statusClass string
+}
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+var _ server.MetricsRecorder = (*Registry)(nil)
+
+// New returns an empty registry with DefaultDurationBuckets.
+func New() *Registry {
+	return &Registry{
+		requests:    make(map[requestKey]int64),
+		parseErrors: make(map[string]int64),
+		durations: histogram{
+			bounds: DefaultDurationBuckets,
+			counts: make([]int64, len(DefaultDurationBuckets)),
+		},
+	}
+}
+
+func (r *Registry) ConnAccepted() {
+	r.connsAccepted.Add(1)
+	r.connsActive.Add(1)
+}
+
+func (r *Registry) ConnClosed() {
+	r.connsActive.Add(-1)
+}
+
+func (r *Registry) HandlerStarted(method string) {
+	r.inFlight.Add(1)
+}
+
+func (r *Registry) HandlerDone(method string, statusCode response.StatusCode, duration time.Duration) {
+	r.inFlight.Add(-1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests[requestKey{method: method, statusClass: statusClass(statusCode)}]++
+	r.durations.observe(duration.Seconds())
+}
+
+func (r *Registry) ParseError(err error) {
+	name := "other"
+	for _, errType := range parseErrorTypes {
+		if errors.Is(err, errType.err) {
+			name = errType.name
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.parseErrors[name]++
+}
+
+func (r *Registry) BytesRead(n int) {
+	r.bytesRead.Add(int64(n))
+}
+
+func (r *Registry) BytesWritten(n int) {
+	r.bytesWritten.Add(int64(n))
+}
+
+// statusClass turns 404 into "4xx". A handler that never wrote a status is
+// counted as "unknown".
+func statusClass(statusCode response.StatusCode) string {
+	if !statusCode.Valid() {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+func (h *histogram) observe(val float64) {
+	for i, bound := range h.bounds {
+		if val <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += val
+	h.count++
+}
+
+// Handler serves the current counts in the Prometheus text format, to be
+// mounted at e.g. GET /metrics.
+func (r *Registry) Handler() server.Handler {
+	return func(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+		body := r.render()
+
+		hdrs := response.GetDefaultHeaders(len(body))
+		hdrs.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(hdrs)
+		w.WriteBody(body)
+
+		return nil
+	}
+}
+
+func (r *Registry) render() []byte {
+	var b strings.Builder
+
+	writeHeader(&b, "http_connections_accepted_total", "counter", "Connections accepted.")
+	fmt.Fprintf(&b, "http_connections_accepted_total %d\n", r.connsAccepted.Load())
+	writeHeader(&b, "http_connections_active", "gauge", "Connections currently open.")
+	fmt.Fprintf(&b, "http_connections_active %d\n", r.connsActive.Load())
+	writeHeader(&b, "http_handlers_in_flight", "gauge", "Handlers currently running.")
+	fmt.Fprintf(&b, "http_handlers_in_flight %d\n", r.inFlight.Load())
+	writeHeader(&b, "http_received_bytes_total", "counter", "Bytes read from connections.")
+	fmt.Fprintf(&b, "http_received_bytes_total %d\n", r.bytesRead.Load())
+	writeHeader(&b, "http_sent_bytes_total", "counter", "Bytes written to connections.")
+	fmt.Fprintf(&b, "http_sent_bytes_total %d\n", r.bytesWritten.Load())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	writeHeader(&b, "http_requests_total", "counter", "Requests handled, by method and status class.")
+	keys := make([]requestKey, 0, len(r.requests))
+	for key := range r.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		return strings.Compare(a.method+" "+a.statusClass, b.method+" "+b.statusClass)
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "http_requests_total{method=%s,code=%s} %d\n",
+			strconv.Quote(key.method), strconv.Quote(key.statusClass), r.requests[key])
+	}
+
+	writeHeader(&b, "http_request_duration_seconds", "histogram", "Time spent in handlers.")
+	for i, bound := range r.durations.bounds {
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), r.durations.counts[i])
+	}
+	fmt.Fprintf(&b, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", r.durations.count)
+	fmt.Fprintf(&b, "http_request_duration_seconds_sum %s\n", strconv.FormatFloat(r.durations.sum, 'g', -1, 64))
+	fmt.Fprintf(&b, "http_request_duration_seconds_count %d\n", r.durations.count)
+
+	writeHeader(&b, "http_parse_errors_total", "counter", "Requests that couldn't be read, by error type.")
+	names := make([]string, 0, len(r.parseErrors))
+	for name := range r.parseErrors {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "http_parse_errors_total{type=%s} %d\n", strconv.Quote(name), r.parseErrors[name])
+	}
+
+	return []byte(b.String())
+}
+
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
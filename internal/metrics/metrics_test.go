@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/arnicfil/go_learn_http_protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := New()
+	reg.ConnAccepted()
+	reg.ConnAccepted()
+	reg.ConnClosed()
+	reg.HandlerStarted("GET")
+	reg.HandlerDone("GET", response.StatusOK, 20*time.Millisecond)
+	reg.HandlerStarted("GET")
+	reg.HandlerDone("GET", response.StatusNotFound, 3*time.Second)
+	reg.HandlerStarted("POST")
+	reg.BytesRead(100)
+	reg.BytesWritten(250)
+	reg.ParseError(fmt.Errorf("wrapped: %w", request.ERROR_HEADERS_TOO_LARGE))
+	reg.ParseError(io.ErrClosedPipe)
+
+	buf := &bytes.Buffer{}
+	herr := reg.Handler()(response.NewWriter(buf), nil)
+	require.Nil(t, herr)
+	out := buf.String()
+
+	assert.Contains(t, out, "Content-Type: text/plain; version=0.0.4; charset=utf-8\r\n")
+	assert.Contains(t, out, "# TYPE http_connections_accepted_total counter\nhttp_connections_accepted_total 2\n")
+	assert.Contains(t, out, "# TYPE http_connections_active gauge\nhttp_connections_active 1\n")
+	assert.Contains(t, out, "http_handlers_in_flight 1\n")
+	assert.Contains(t, out, "http_received_bytes_total 100\n")
+	assert.Contains(t, out, "http_sent_bytes_total 250\n")
+	assert.Contains(t, out, "http_requests_total{method=\"GET\",code=\"2xx\"} 1\nhttp_requests_total{method=\"GET\",code=\"4xx\"} 1\n")
+	assert.Contains(t, out, "http_request_duration_seconds_bucket{le=\"0.01\"} 0\n")
+	assert.Contains(t, out, "http_request_duration_seconds_bucket{le=\"0.025\"} 1\n")
+	assert.Contains(t, out, "http_request_duration_seconds_bucket{le=\"5\"} 2\n")
+	assert.Contains(t, out, "http_request_duration_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, out, "http_request_duration_seconds_sum 3.02\n")
+	assert.Contains(t, out, "http_request_duration_seconds_count 2\n")
+	assert.Contains(t, out, "http_parse_errors_total{type=\"headers_too_large\"} 1\nhttp_parse_errors_total{type=\"other\"} 1\n")
+}
+
+func TestRegistryWithServer(t *testing.T) {
+	reg := New()
+	handler := func(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+		if req.URL.Path == "/metrics" {
+			return reg.Handler()(w, req)
+		}
+
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := server.ServeListener(lsn, handler, server.WithMetrics(reg),
+		server.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nBROKEN\r\n\r\n"))
+	io.ReadAll(conn)
+	conn.Close()
+
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /metrics HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	out, err := io.ReadAll(bufio.NewReader(conn))
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.Contains(t, string(out), "http_connections_accepted_total 2\n")
+	assert.Contains(t, string(out), "http_requests_total{method=\"GET\",code=\"2xx\"} 1\n")
+	assert.Contains(t, string(out), "http_parse_errors_total{type=\"malformed_request_line\"} 1\n")
+	assert.Contains(t, string(out), "http_handlers_in_flight 1\n")
+	assert.Contains(t, string(out), "http_received_bytes_total ")
+}
@@ -0,0 +1,72 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxDrainSize is how much of an unread body Close will read and throw away
+// to keep the connection usable for the next request.
+const maxDrainSize = 256 << 10
+
+var ERROR_BODY_CLOSED = errors.New("Error reading from a closed body")
+var ERROR_BODY_NOT_DRAINED = errors.New("Error body too large to drain, connection can't be reused")
+
+// bodyReader decodes the body of a streaming request straight from the
+// parser's connection, honoring Content-Length and chunked framing.
+type bodyReader struct {
+	parser *Parser
+	req    *Request
+	err    error
+	closed bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ERROR_BODY_CLOSED
+	}
+
+	for len(b.req.decoded) == 0 {
+		if b.req.state == Done {
+			return 0, io.EOF
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		b.err = b.parser.parseUntil(b.req, func() bool {
+			return len(b.req.decoded) > 0 || b.req.state == Done
+		})
+		if b.err != nil && b.parser.fatal == nil {
+			b.parser.fatal = b.err
+		}
+	}
+
+	n := copy(p, b.req.decoded)
+	b.req.decoded = b.req.decoded[n:]
+
+	return n, nil
+}
+
+// Close discards whatever the handler left unread. When too much is left or
+// the body is broken, the parser is poisoned so the connection gets dropped
+// instead of reading the leftovers as the next request.
+func (b *bodyReader) Close() error {
+	if b.closed {
+		return nil
+	}
+
+	_, err := io.CopyN(io.Discard, b, maxDrainSize)
+	b.closed = true
+	if err == io.EOF || (err == nil && b.req.state == Done && len(b.req.decoded) == 0) {
+		return nil
+	}
+
+	if err == nil {
+		err = ERROR_BODY_NOT_DRAINED
+	}
+	b.parser.fatal = fmt.Errorf("Error while draining body: %w", err)
+
+	return b.parser.fatal
+}
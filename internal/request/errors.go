@@ -0,0 +1,35 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+)
+
+var ERROR_MALFORMED_REQUEST_LINE = errors.New("Error request line is malformed")
+var ERROR_INVALID_METHOD = errors.New("Error method contains invalid characters")
+var ERROR_METHOD_NOT_IMPLEMENTED = errors.New("Error method is not implemented")
+var ERROR_UNSUPPORTED_VERSION = errors.New("Error http version is not supported")
+var ERROR_MALFORMED_HEADER = errors.New("Error header is malformed")
+var ERROR_INVALID_CONTENT_LENGTH = headers.ERROR_INVALID_CONTENT_LENGTH
+var ERROR_BODY_LENGTH_MISMATCH = errors.New("Error body is shorter than reported in header")
+var ERROR_MALFORMED_CHUNK = errors.New("Error chunked body is malformed")
+var ERROR_INCOMPLETE_REQUEST = errors.New("Error connection ended in the middle of a request")
+var ERROR_EXPECTATION_FAILED = errors.New("Error expectation not supported")
+var ERROR_NO_REQUEST = errors.New("Error connection ended before a request started")
+
+// ParseError records the parser state a request failed in. The cause is one
+// of the sentinel errors above and can be matched with errors.Is.
+type ParseError struct {
+	State RequestState
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Error while parsing data in state %d: %v", e.State, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
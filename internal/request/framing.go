@@ -0,0 +1,54 @@
+package request
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+)
+
+// A request whose body length is ambiguous is never guessed at: a proxy in
+// front of the server may have framed it differently, and the bytes either
+// side disagrees on become a smuggled request (RFC 9112, section 6.3).
+
+var ERROR_DUPLICATE_CONTENT_LENGTH = headers.ERROR_DUPLICATE_CONTENT_LENGTH
+var ERROR_AMBIGUOUS_FRAMING = errors.New("Error request has both content length and transfer encoding")
+var ERROR_CHUNKED_NOT_FINAL = errors.New("Error chunked is not the final transfer coding")
+var ERROR_UNSUPPORTED_TRANSFER_CODING = errors.New("Error transfer coding is not implemented")
+
+// transferCodings returns the codings of every Transfer-Encoding field in the
+// order they were applied, lowercased. Only a chunked final coding is
+// accepted, since that is the only one the parser can decode.
+func transferCodings(hdrs *headers.Headers) ([]string, error) {
+	values := hdrs.Values("Transfer-Encoding")
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(hdrs.Values("Content-Length")) > 0 {
+		return nil, ERROR_AMBIGUOUS_FRAMING
+	}
+
+	var codings []string
+	for _, val := range values {
+		for _, coding := range strings.Split(val, ",") {
+			// Empty list elements are allowed and ignored.
+			if coding = strings.Trim(coding, " \t"); coding != "" {
+				codings = append(codings, strings.ToLower(coding))
+			}
+		}
+	}
+	if len(codings) == 0 {
+		return nil, ERROR_CHUNKED_NOT_FINAL
+	}
+
+	for i, coding := range codings {
+		if (coding == "chunked") != (i == len(codings)-1) {
+			return nil, ERROR_CHUNKED_NOT_FINAL
+		}
+	}
+	if len(codings) > 1 {
+		return nil, ERROR_UNSUPPORTED_TRANSFER_CODING
+	}
+
+	return codings, nil
+}
@@ -0,0 +1,66 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smugglingPayloads are request heads that front ends and back ends are
+// known to frame differently. Each must be refused rather than guessed at.
+var smugglingPayloads = []struct {
+	name    string
+	headers string
+	err     error
+}{
+	{"CL.TE", "Content-Length: 6\r\nTransfer-Encoding: chunked\r\n", ERROR_AMBIGUOUS_FRAMING},
+	{"TE.CL", "Transfer-Encoding: chunked\r\nContent-Length: 6\r\n", ERROR_AMBIGUOUS_FRAMING},
+	{"CL.CL conflicting", "Content-Length: 6\r\nContent-Length: 5\r\n", ERROR_DUPLICATE_CONTENT_LENGTH},
+	{"CL.CL identical", "Content-Length: 5\r\nContent-Length: 5\r\n", ERROR_DUPLICATE_CONTENT_LENGTH},
+	{"CL list", "Content-Length: 5, 5\r\n", ERROR_DUPLICATE_CONTENT_LENGTH},
+	{"CL with sign", "Content-Length: +5\r\n", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL negative", "Content-Length: -1\r\n", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL hex", "Content-Length: 0x5\r\n", ERROR_INVALID_CONTENT_LENGTH},
+	{"CL empty", "Content-Length: \r\n", ERROR_INVALID_CONTENT_LENGTH},
+	{"TE chunked not final", "Transfer-Encoding: chunked, identity\r\n", ERROR_CHUNKED_NOT_FINAL},
+	{"TE chunked twice", "Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n", ERROR_CHUNKED_NOT_FINAL},
+	{"TE obfuscated", "Transfer-Encoding: xchunked\r\n", ERROR_CHUNKED_NOT_FINAL},
+	{"TE empty", "Transfer-Encoding: \r\n", ERROR_CHUNKED_NOT_FINAL},
+	{"TE unknown coding", "Transfer-Encoding: gzip, chunked\r\n", ERROR_UNSUPPORTED_TRANSFER_CODING},
+	{"TE split fields", "Transfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n", ERROR_UNSUPPORTED_TRANSFER_CODING},
+	{"TE folded", "Transfer-Encoding:\r\n chunked\r\n", ERROR_MALFORMED_HEADER},
+	{"TE space before colon", "Transfer-Encoding : chunked\r\n", ERROR_MALFORMED_HEADER},
+	{"TE first line indented", " Transfer-Encoding: chunked\r\n", ERROR_MALFORMED_HEADER},
+	{"TE first line tab", "\tTransfer-Encoding: chunked\r\n", ERROR_MALFORMED_HEADER},
+}
+
+func TestSmugglingPayloads(t *testing.T) {
+	for _, payload := range smugglingPayloads {
+		t.Run(payload.name, func(t *testing.T) {
+			// The payload comes right after the request line, where an
+			// indented line can't be taken for folding.
+			data := "POST / HTTP/1.1\r\n" + payload.headers + "Host: localhost\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n"
+			_, err := RequestFromReader(strings.NewReader(data))
+			require.ErrorIs(t, err, payload.err)
+		})
+	}
+}
+
+func TestFraming(t *testing.T) {
+	// Test: Codings are matched without regard to case
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+
+	// Test: Empty list elements are ignored
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: , chunked\r\n\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: Leading zeros are still a single length
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 003\r\n\r\nabc"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+}
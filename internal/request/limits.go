@@ -0,0 +1,35 @@
+package request
+
+import "errors"
+
+// Limits bounds how much of a request the parser will accept. A zero field
+// means that part of the request is not limited.
+type Limits struct {
+	MaxRequestLineSize int
+	MaxHeaderBytes     int
+	MaxHeaderCount     int
+	MaxBodySize        int64
+	// UnfoldObsFold accepts header values continued on the next line, which
+	// are otherwise rejected, by joining the lines with a space.
+	UnfoldObsFold bool
+}
+
+const maxChunkLineSize = 4096
+
+var ERROR_REQUEST_LINE_TOO_LONG = errors.New("Error request line exceeds the size limit")
+var ERROR_HEADERS_TOO_LARGE = errors.New("Error header block exceeds the size limit")
+var ERROR_TOO_MANY_HEADERS = errors.New("Error header count exceeds the limit")
+var ERROR_BODY_TOO_LARGE = errors.New("Error body exceeds the size limit")
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxRequestLineSize: 8 << 10,
+		MaxHeaderBytes:     1 << 20,
+		MaxHeaderCount:     100,
+		MaxBodySize:        10 << 20,
+	}
+}
+
+func exceeds(size int, limit int) bool {
+	return limit > 0 && size > limit
+}
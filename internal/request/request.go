@@ -1,9 +1,13 @@
 package request
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
@@ -17,18 +21,84 @@ const (
 	Initialized RequestState = iota
 	ParsingHeaders
 	ParsingBody
+	ParsingBodyData
+	ParsingChunkSize
+	ParsingChunkData
+	ParsingTrailers
 	Done
 )
 
 const bufferSize = 8
 
-var ERORR_LEN = errors.New("Error body length is greater that reported in header")
+var knownMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
 
 type Request struct {
 	RequestLine RequestLine
+	URL         *URL
 	state       RequestState
-	Headers     headers.Headers
+	Headers     *headers.Headers
 	Body        []byte
+	BodyReader  io.ReadCloser
+	Trailers    *headers.Headers
+	Params      map[string]string
+	// TLS is the state of the TLS connection the request came in on, or nil
+	// for plain connections. Client certificates are in PeerCertificates.
+	TLS *tls.ConnectionState
+	// RemoteAddr is the address of the client, as "host:port".
+	RemoteAddr string
+
+	ctx           context.Context
+	bodyRemaining int64
+	bodySize      int64
+	decoded       []byte
+	limits        Limits
+	headerBytes   int
+	headerCount   int
+}
+
+// Context returns the request's context. The server cancels it when the
+// client goes away, the server is closed or the handler runs out of time.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context replaced by ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and
+// is holding the body back until it gets a 100 Continue. HTTP/1.0 clients
+// can't be sent a 1xx response, so their expectation is ignored.
+func (r *Request) ExpectsContinue() bool {
+	if r.state == Done || len(r.decoded) > 0 || r.RequestLine.HttpVersion != "1.1" {
+		return false
+	}
+
+	expect, ok := r.Headers.Get("Expect")
+	return ok && strings.EqualFold(strings.TrimSpace(expect), "100-continue")
+}
+
+// BodyPending reports whether some of the body is still on the connection.
+// Once it isn't, reading BodyReader no longer touches the parser, which can
+// go on to the next request.
+func (r *Request) BodyPending() bool {
+	return r.state != Done
+}
+
+// PathValue returns the path parameter a router captured under name.
+func (r *Request) PathValue(name string) string {
+	return r.Params[name]
 }
 
 type RequestLine struct {
@@ -37,44 +107,155 @@ type RequestLine struct {
 	Method        string
 }
 
+// Parser reads consecutive requests from one connection. Bytes read past the
+// end of a request stay buffered and start the next call to ReadRequest.
+type Parser struct {
+	reader      io.Reader
+	buffer      []byte
+	readToIndex int
+	err         error
+	fatal       error
+	limits      Limits
+}
+
+func NewParser(reader io.Reader) *Parser {
+	return NewParserWithLimits(reader, DefaultLimits())
+}
+
+func NewParserWithLimits(reader io.Reader, limits Limits) *Parser {
+	return &Parser{
+		reader: reader,
+		buffer: make([]byte, bufferSize),
+		limits: limits,
+	}
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buffer := make([]byte, bufferSize)
+	return NewParser(reader).ReadRequest()
+}
+
+// ReadRequest reads a whole request, body included, into memory.
+func (p *Parser) ReadRequest() (*Request, error) {
+	req, err := p.ReadStreamingRequest()
+	if err != nil {
+		return req, err
+	}
+
+	err = req.ReadBody()
+	if err != nil {
+		return &Request{}, err
+	}
+
+	return req, nil
+}
+
+// ReadBody reads the rest of a streaming request's body into Body.
+// BodyReader is replaced by a reader over the same bytes.
+func (r *Request) ReadBody() error {
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return fmt.Errorf("Error while reading body: %w", err)
+	}
+
+	r.Body = body
+	r.BodyReader = io.NopCloser(bytes.NewReader(body))
+
+	return nil
+}
 
+// WaitForRequest blocks until the first byte of the next request has
+// arrived, so callers can time the wait between requests apart from the
+// request itself.
+func (p *Parser) WaitForRequest() error {
+	if p.fatal != nil {
+		return p.fatal
+	}
+
+	for p.readToIndex == 0 {
+		if p.err != nil {
+			return fmt.Errorf("%w: %w", ERROR_NO_REQUEST, p.err)
+		}
+		p.read()
+	}
+
+	return nil
+}
+
+// ReadStreamingRequest returns as soon as the request line and headers are
+// parsed. The body is left on the connection and pulled through
+// req.BodyReader, which must be read to EOF or closed before the next request
+// can be read.
+func (p *Parser) ReadStreamingRequest() (*Request, error) {
 	var req Request
 	req.state = Initialized
+	req.limits = p.limits
 
-	readToIndex := 0
+	// Going one state past ParsingBody checks the framing headers before the
+	// handler runs, without waiting for any body bytes.
+	err := p.parseUntil(&req, func() bool { return req.state > ParsingBody })
+	if err != nil {
+		return &Request{}, err
+	}
 
-	for req.state != Done {
-		if readToIndex == len(buffer) {
-			newBuffer := make([]byte, len(buffer)*2)
-			copy(newBuffer, buffer[:readToIndex])
-			buffer = newBuffer
-		}
+	req.BodyReader = &bodyReader{parser: p, req: &req}
 
-		numBytesRead, err := reader.Read(buffer[readToIndex:])
-		readToIndex += numBytesRead
+	return &req, nil
+}
+
+// parseUntil feeds buffered bytes to req, reading more from the connection
+// whenever they run out, until stop reports true.
+func (p *Parser) parseUntil(req *Request, stop func() bool) error {
+	if p.fatal != nil {
+		return p.fatal
+	}
 
-		numBytesParsed, perr := req.parse(buffer[:readToIndex])
+	for {
+		numBytesParsed, perr := req.parse(p.buffer[:p.readToIndex])
 		if perr != nil {
-			return &Request{}, fmt.Errorf("Error while parsing data: %v", perr)
+			return perr
 		}
 
 		if numBytesParsed > 0 {
-			copy(buffer, buffer[numBytesParsed:readToIndex])
-			readToIndex -= numBytesParsed
+			copy(p.buffer, p.buffer[numBytesParsed:p.readToIndex])
+			p.readToIndex -= numBytesParsed
 		}
 
-		if err != nil {
-			if err == io.EOF && req.state != Done {
-				return &Request{}, fmt.Errorf("Error final parsing: %v", err)
+		if stop() {
+			return nil
+		}
+
+		if p.err != nil {
+			if req.state == Initialized && p.readToIndex == 0 {
+				return fmt.Errorf("%w: %w", ERROR_NO_REQUEST, p.err)
+			}
+
+			if p.err == io.EOF {
+				cause := ERROR_INCOMPLETE_REQUEST
+				if req.state >= ParsingBody {
+					cause = ERROR_BODY_LENGTH_MISMATCH
+				}
+				return fmt.Errorf("Error final parsing: %w: %w", cause, io.ErrUnexpectedEOF)
 			}
 
-			return &Request{}, fmt.Errorf("Error while reading from reader: %v", err)
+			return fmt.Errorf("Error while reading from reader: %w", p.err)
 		}
+
+		p.read()
 	}
+}
 
-	return &req, nil
+// read appends the next read from the connection to the buffer, growing it
+// when it is full.
+func (p *Parser) read() {
+	if p.readToIndex == len(p.buffer) {
+		newBuffer := make([]byte, len(p.buffer)*2)
+		copy(newBuffer, p.buffer[:p.readToIndex])
+		p.buffer = newBuffer
+	}
+
+	numBytesRead, err := p.reader.Read(p.buffer[p.readToIndex:])
+	p.readToIndex += numBytesRead
+	p.err = err
 }
 
 func parseRequestLine(data string) (RequestLine, int, error) {
@@ -86,19 +267,25 @@ func parseRequestLine(data string) (RequestLine, int, error) {
 	}
 
 	parts := strings.Split(line, " ")
-	if len(parts) != 3 {
-		return RequestLine{}, 0, errors.New("Request line doesn't have 3 parts")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return RequestLine{}, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
 	for _, c := range parts[0] {
 		if !unicode.IsUpper(c) || !unicode.IsLetter(c) {
-			return RequestLine{}, 0, errors.New("Method contains invalid characters")
+			return RequestLine{}, 0, ERROR_INVALID_METHOD
 		}
 	}
+	if !slices.Contains(knownMethods, parts[0]) {
+		return RequestLine{}, 0, ERROR_METHOD_NOT_IMPLEMENTED
+	}
 
 	version_parts := strings.Split(parts[2], "/")
-	if len(version_parts) != 2 || version_parts[1] != "1.1" {
-		return RequestLine{}, 0, errors.New("Version part is invalid")
+	if len(version_parts) != 2 || version_parts[0] != "HTTP" || !isVersionNumber(version_parts[1]) {
+		return RequestLine{}, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
+	if version_parts[1] != "1.1" && version_parts[1] != "1.0" {
+		return RequestLine{}, 0, ERROR_UNSUPPORTED_VERSION
 	}
 
 	return RequestLine{
@@ -111,12 +298,13 @@ func parseRequestLine(data string) (RequestLine, int, error) {
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.state != Done {
+		prevState := r.state
 		numBytesParsed, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return 0, fmt.Errorf("Error while parsing data in state %d: %v", r.state, err)
+			return 0, &ParseError{State: r.state, Err: err}
 		}
 
-		if numBytesParsed == 0 {
+		if numBytesParsed == 0 && r.state == prevState {
 			return totalBytesParsed, nil
 		}
 
@@ -134,8 +322,20 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, err
 		}
 		if numBytesParsed == 0 {
+			if exceeds(len(data), r.limits.MaxRequestLineSize) {
+				return 0, ERROR_REQUEST_LINE_TOO_LONG
+			}
 			return 0, nil
 		}
+		if exceeds(numBytesParsed-2, r.limits.MaxRequestLineSize) {
+			return 0, ERROR_REQUEST_LINE_TOO_LONG
+		}
+
+		url, err := parseTarget(newRequestLine.Method, newRequestLine.RequestTarget)
+		if err != nil {
+			return 0, err
+		}
+		r.URL = url
 
 		r.RequestLine = newRequestLine
 		r.state = ParsingHeaders
@@ -147,13 +347,10 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			r.Headers = headers.NewHeaders()
 		}
 
-		numBytesParsed, done, err := r.Headers.Parse(data)
+		numBytesParsed, done, err := r.parseField(r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
-		if numBytesParsed == 0 {
-			return 0, nil
-		}
 
 		if done {
 			r.state = ParsingBody
@@ -162,27 +359,111 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		return numBytesParsed, nil
 
 	case ParsingBody:
-		val, ok := r.Headers.Get("Content-Length")
+		if expect, ok := r.Headers.Get("Expect"); ok && !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+			return 0, ERROR_EXPECTATION_FAILED
+		}
+
+		codings, err := transferCodings(r.Headers)
+		if err != nil {
+			return 0, err
+		}
+		if len(codings) > 0 {
+			r.state = ParsingChunkSize
+			return 0, nil
+		}
+
+		reportedLen, ok, err := r.Headers.ContentLength()
+		if err != nil {
+			return 0, err
+		}
 		if !ok {
 			r.state = Done
 			return 0, nil
 		}
+		if r.limits.MaxBodySize > 0 && reportedLen > r.limits.MaxBodySize {
+			return 0, ERROR_BODY_TOO_LARGE
+		}
+
+		r.bodyRemaining = reportedLen
+		r.state = ParsingBodyData
+		if reportedLen == 0 {
+			r.state = Done
+		}
+
+		return 0, nil
+
+	case ParsingBodyData:
+		// Bytes past the reported length belong to the next pipelined request.
+		numBytesParsed := int(min(r.bodyRemaining, int64(len(data))))
+		r.decoded = append(r.decoded, data[:numBytesParsed]...)
+		r.bodyRemaining -= int64(numBytesParsed)
+
+		if r.bodyRemaining == 0 {
+			r.state = Done
+		}
+
+		return numBytesParsed, nil
+
+	case ParsingChunkSize:
+		idx := bytes.Index(data, []byte("\r\n"))
+		if idx == -1 {
+			if len(data) > maxChunkLineSize {
+				return 0, ERROR_MALFORMED_CHUNK
+			}
+			return 0, nil
+		}
 
-		r.Body = append(r.Body, data...)
-		reportedLen, err := strconv.Atoi(val)
+		size, err := parseChunkSize(string(data[:idx]))
 		if err != nil {
-			return 0, headers.ERROR_MALFORMED
+			return 0, err
+		}
+		r.bodySize += size
+		if r.limits.MaxBodySize > 0 && r.bodySize > r.limits.MaxBodySize {
+			return 0, ERROR_BODY_TOO_LARGE
+		}
+
+		r.bodyRemaining = size
+		r.state = ParsingChunkData
+		if size == 0 {
+			r.state = ParsingTrailers
+		}
+
+		return idx + 2, nil
+
+	case ParsingChunkData:
+		if r.bodyRemaining == 0 {
+			if len(data) < 2 {
+				return 0, nil
+			}
+			if string(data[:2]) != "\r\n" {
+				return 0, ERROR_MALFORMED_CHUNK
+			}
+
+			r.state = ParsingChunkSize
+			return 2, nil
 		}
 
-		if len(r.Body) > reportedLen {
-			return 0, ERORR_LEN
+		numBytesParsed := int(min(r.bodyRemaining, int64(len(data))))
+		r.decoded = append(r.decoded, data[:numBytesParsed]...)
+		r.bodyRemaining -= int64(numBytesParsed)
+
+		return numBytesParsed, nil
+
+	case ParsingTrailers:
+		if r.Trailers == nil {
+			r.Trailers = headers.NewHeaders()
 		}
 
-		if len(r.Body) == reportedLen {
+		numBytesParsed, done, err := r.parseField(r.Trailers, data)
+		if err != nil {
+			return 0, err
+		}
+
+		if done {
 			r.state = Done
 		}
 
-		return len(data), nil
+		return numBytesParsed, nil
 
 	case Done:
 		return 0, errors.New("Error trying to read data in a done state")
@@ -190,3 +471,59 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 
 	return 0, errors.New("Error unknown state")
 }
+
+// parseField parses one header or trailer line, counting it against the
+// header limits.
+func (r *Request) parseField(hdrs *headers.Headers, data []byte) (int, bool, error) {
+	parse := hdrs.Parse
+	if r.limits.UnfoldObsFold {
+		parse = hdrs.ParseUnfold
+	}
+
+	numBytesParsed, done, err := parse(data)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %w", ERROR_MALFORMED_HEADER, err)
+	}
+
+	if numBytesParsed == 0 {
+		if exceeds(r.headerBytes+len(data), r.limits.MaxHeaderBytes) {
+			return 0, false, ERROR_HEADERS_TOO_LARGE
+		}
+		return 0, false, nil
+	}
+
+	r.headerBytes += numBytesParsed
+	if exceeds(r.headerBytes, r.limits.MaxHeaderBytes) {
+		return 0, false, ERROR_HEADERS_TOO_LARGE
+	}
+
+	if !done {
+		r.headerCount++
+		if exceeds(r.headerCount, r.limits.MaxHeaderCount) {
+			return 0, false, ERROR_TOO_MANY_HEADERS
+		}
+	}
+
+	return numBytesParsed, done, nil
+}
+
+func isVersionNumber(s string) bool {
+	return len(s) == 3 && unicode.IsDigit(rune(s[0])) && s[1] == '.' && unicode.IsDigit(rune(s[2]))
+}
+
+// parseChunkSize reads the hex size of a chunk-size line, ignoring any chunk
+// extensions after ';'.
+func parseChunkSize(line string) (int64, error) {
+	sizePart, _, _ := strings.Cut(line, ";")
+	sizePart = strings.TrimRight(sizePart, " \t")
+	if sizePart == "" || strings.Trim(sizePart, "0123456789abcdefABCDEF") != "" {
+		return 0, ERROR_MALFORMED_CHUNK
+	}
+
+	size, err := strconv.ParseInt(sizePart, 16, 64)
+	if err != nil || size < 0 {
+		return 0, ERROR_MALFORMED_CHUNK
+	}
+
+	return size, nil
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -65,9 +66,9 @@ func TestRequestAndHeadersLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -93,8 +94,8 @@ func TestRequestAndHeadersLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, another", r.Headers["host"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069", "another"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 
 	// Test: Case insensitive header
 	reader = &chunkReader{
@@ -104,7 +105,7 @@ func TestRequestAndHeadersLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "one, two", r.Headers["host"])
+	assert.Equal(t, []string{"one", "two"}, r.Headers.Values("host"))
 
 	// Test: Missing end of headers
 	reader = &chunkReader{
@@ -180,6 +181,428 @@ func TestBodyParsing(t *testing.T) {
 	require.NotNil(t, r)
 }
 
+func TestChunkedBodyParsing(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"7;name=value\r\n" +
+			", world\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello, world", string(r.Body))
+	require.NotNil(t, r.Trailers)
+	assert.Equal(t, []string{"abc"}, r.Trailers.Values("x-checksum"))
+
+	// Test: Chunked body without trailers followed by another request
+	parser := NewParser(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"A\r\n" +
+		"0123456789\r\n" +
+		"0\r\n" +
+		"\r\n" +
+		"GET /next HTTP/1.1\r\n\r\n"))
+	r, err = parser.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+	r, err = parser.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Invalid chunk size
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"zz\r\n" +
+		"hello\r\n" +
+		"0\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+
+	// Test: Chunk data longer than its size
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"3\r\n" +
+		"hello\r\n" +
+		"0\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_CHUNK)
+
+	// Test: Missing last chunk
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\n" +
+		"hello\r\n"))
+	require.Error(t, err)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Headers are returned before the body is read
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"Hello world!\n",
+		numBytesPerRead: 3,
+	}
+	parser := NewParser(reader)
+	r, err := parser.ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+	assert.Nil(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello world!\n", string(body))
+
+	// Test: Chunked body is decoded while streaming
+	parser = NewParser(&chunkReader{
+		data: "POST / HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"4\r\nWiki\r\n5\r\npedia\r\n0\r\n\r\n",
+		numBytesPerRead: 2,
+	})
+	r, err = parser.ReadStreamingRequest()
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "Wikipedia", string(body))
+
+	// Test: Closing a partly read body drains it for the next request
+	parser = NewParser(strings.NewReader("POST /first HTTP/1.1\r\n" +
+		"Content-Length: 10\r\n" +
+		"\r\n" +
+		"0123456789" +
+		"GET /second HTTP/1.1\r\n\r\n"))
+	r, err = parser.ReadStreamingRequest()
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r.BodyReader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(buf))
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(buf)
+	require.ErrorIs(t, err, ERROR_BODY_CLOSED)
+	r, err = parser.ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: Body shorter than reported content length
+	parser = NewParser(strings.NewReader("POST / HTTP/1.1\r\n" +
+		"Content-Length: 20\r\n" +
+		"\r\n" +
+		"partial"))
+	r, err = parser.ReadStreamingRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Error(t, r.BodyReader.Close())
+	_, err = parser.ReadStreamingRequest()
+	require.Error(t, err)
+}
+
+func TestParserLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineSize: 32,
+		MaxHeaderBytes:     64,
+		MaxHeaderCount:     2,
+		MaxBodySize:        8,
+	}
+
+	// Test: Request line over the limit
+	reader := &chunkReader{
+		data:            "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err := NewParserWithLimits(reader, limits).ReadRequest()
+	require.ErrorIs(t, err, ERROR_REQUEST_LINE_TOO_LONG)
+
+	// Test: Header block over the limit
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 64) + "\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = NewParserWithLimits(reader, limits).ReadRequest()
+	require.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+
+	// Test: Too many header fields
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = NewParserWithLimits(reader, limits).ReadRequest()
+	require.ErrorIs(t, err, ERROR_TOO_MANY_HEADERS)
+
+	// Test: Content-Length over the body limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789",
+		numBytesPerRead: 3,
+	}
+	_, err = NewParserWithLimits(reader, limits).ReadRequest()
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: Chunked body over the body limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = NewParserWithLimits(reader, limits).ReadRequest()
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: Request within every limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 8\r\n\r\n12345678",
+		numBytesPerRead: 3,
+	}
+	r, err := NewParserWithLimits(reader, limits).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(r.Body))
+}
+
+func TestParseErrors(t *testing.T) {
+	// Test: Missing part in request line
+	_, err := RequestFromReader(strings.NewReader("GET HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_REQUEST_LINE)
+
+	// Test: Method with invalid characters
+	_, err = RequestFromReader(strings.NewReader("G3T / HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_METHOD)
+
+	// Test: Unknown method
+	_, err = RequestFromReader(strings.NewReader("BREW / HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_METHOD_NOT_IMPLEMENTED)
+
+	// Test: Well formed but unsupported version
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/2.0\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_VERSION)
+
+	// Test: Malformed version
+	_, err = RequestFromReader(strings.NewReader("GET / HTTX/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_REQUEST_LINE)
+
+	// Test: Malformed header carries the parser state
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost localhost\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_HEADER)
+	var perr *ParseError
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, ParsingHeaders, perr.State)
+
+	// Test: Invalid content length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: ten\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_CONTENT_LENGTH)
+
+	// Test: Body shorter than content length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nshort"))
+	require.ErrorIs(t, err, ERROR_BODY_LENGTH_MISMATCH)
+
+	// Test: Connection ends inside the headers
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	require.ErrorIs(t, err, ERROR_INCOMPLETE_REQUEST)
+
+	// Test: Unknown expectation
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nExpect: teapot\r\nContent-Length: 1\r\n\r\nx"))
+	require.ErrorIs(t, err, ERROR_EXPECTATION_FAILED)
+
+	// Test: Bare CR inside a header value
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-Name: a\rb\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_HEADER)
+	require.ErrorIs(t, err, headers.ERROR_INVALID_VALUE)
+
+	// Test: Obsolete line folding
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-Name: a\r\n b\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_MALFORMED_HEADER)
+	require.ErrorIs(t, err, headers.ERROR_OBS_FOLD)
+}
+
+func TestUnfoldObsFold(t *testing.T) {
+	limits := DefaultLimits()
+	limits.UnfoldObsFold = true
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Name: a\r\n\tb\r\n  c\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := NewParserWithLimits(reader, limits).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a b c"}, r.Headers.Values("X-Name"))
+	assert.Equal(t, []string{"localhost"}, r.Headers.Values("Host"))
+}
+
+func TestExpectsContinue(t *testing.T) {
+	// Test: Body held back by the client
+	r, err := NewParser(strings.NewReader("POST / HTTP/1.1\r\nExpect: 100-Continue\r\nContent-Length: 5\r\n\r\n")).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+
+	// Test: Body already sent
+	r, err = NewParser(strings.NewReader("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello")).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: No body to ask for
+	r, err = NewParser(strings.NewReader("GET / HTTP/1.1\r\nExpect: 100-continue\r\n\r\n")).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: Ignored from HTTP/1.0 clients
+	r, err = NewParser(strings.NewReader("POST / HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+}
+
+func TestBodyPending(t *testing.T) {
+	// Test: No body
+	r, err := NewParser(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.False(t, r.BodyPending())
+
+	// Test: Body still on the connection until it is read
+	reader := io.MultiReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\n"), strings.NewReader("hello"))
+	r, err = NewParser(reader).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.True(t, r.BodyPending())
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.False(t, r.BodyPending())
+
+	// Test: Body that arrived with the headers is already off the connection
+	r, err = NewParser(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")).ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.False(t, r.BodyPending())
+}
+
+func TestRequestTargetParsing(t *testing.T) {
+	// Test: Origin-form with decoded path and multi-valued query
+	r, err := RequestFromReader(strings.NewReader("GET /caf%C3%A9/a%20b?tag=x&tag=y&q=hello+world&empty HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	require.NotNil(t, r.URL)
+	assert.Equal(t, OriginForm, r.URL.Form)
+	assert.Equal(t, "/café/a b", r.URL.Path)
+	assert.Equal(t, "/caf%C3%A9/a%20b", r.URL.RawPath)
+	assert.Equal(t, "/caf%C3%A9/a%20b", r.URL.EscapedPath())
+	assert.Equal(t, "tag=x&tag=y&q=hello+world&empty", r.URL.RawQuery)
+	assert.Equal(t, []string{"x", "y"}, r.URL.Query["tag"])
+	assert.Equal(t, "hello world", r.URL.Query.Get("q"))
+	assert.True(t, r.URL.Query.Has("empty"))
+
+	// Test: Escaped path is canonical
+	r, err = RequestFromReader(strings.NewReader("GET /%7euser/%41 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/~user/A", r.URL.Path)
+	assert.Equal(t, "/~user/A", r.URL.EscapedPath())
+
+	// Test: Absolute-form
+	r, err = RequestFromReader(strings.NewReader("GET http://example.com:8080/index.html?x=1 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.URL.Form)
+	assert.Equal(t, "http", r.URL.Scheme)
+	assert.Equal(t, "example.com:8080", r.URL.Host)
+	assert.Equal(t, "/index.html", r.URL.Path)
+	assert.Equal(t, "1", r.URL.Query.Get("x"))
+
+	// Test: Authority-form
+	r, err = RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.URL.Form)
+	assert.Equal(t, "example.com:443", r.URL.Host)
+
+	// Test: Asterisk-form
+	r, err = RequestFromReader(strings.NewReader("OPTIONS * HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.URL.Form)
+
+	// Test: Asterisk-form outside OPTIONS
+	_, err = RequestFromReader(strings.NewReader("GET * HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+
+	// Test: Relative target
+	_, err = RequestFromReader(strings.NewReader("GET index.html HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+
+	// Test: Broken percent-encoding
+	_, err = RequestFromReader(strings.NewReader("GET /a%2 HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+
+	// Test: Fragment in target
+	_, err = RequestFromReader(strings.NewReader("GET /a#top HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_TARGET)
+
+	// Test: Dot segments are removed
+	for target, path := range map[string]string{
+		"/a/./b/../c": "/a/c",
+		"/a/b/..":     "/a/",
+		"/../../etc":  "/etc",
+		"/./":         "/",
+		"/a/..b/.c/.": "/a/..b/.c/",
+	} {
+		r, err = RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err, target)
+		assert.Equal(t, path, r.URL.Path, target)
+		assert.Equal(t, path, r.URL.RawPath, target)
+	}
+
+	// Test: Unsafe encodings
+	_, err = RequestFromReader(strings.NewReader("GET /a%00b HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_UNSAFE_ENCODING)
+	_, err = RequestFromReader(strings.NewReader("GET /files/..%2Fsecret HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_UNSAFE_ENCODING)
+	_, err = RequestFromReader(strings.NewReader("GET /files/%2e%2e/secret HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ERROR_UNSAFE_ENCODING)
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	// Test: Several requests sent back-to-back on one connection
+	reader := &chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"helloGET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n" +
+			"GET /third HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	parser := NewParser(reader)
+
+	r, err := parser.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = parser.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+
+	r, err = parser.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+
+	// Test: Connection ends cleanly between requests
+	_, err = parser.ReadRequest()
+	require.ErrorIs(t, err, ERROR_NO_REQUEST)
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection ends in the middle of a request
+	parser = NewParser(strings.NewReader("GET / HTTP/1.1\r\n\r\nGET /partial HTT"))
+	_, err = parser.ReadRequest()
+	require.NoError(t, err)
+	_, err = parser.ReadRequest()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ERROR_NO_REQUEST)
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
@@ -0,0 +1,293 @@
+package request
+
+import (
+	"errors"
+	"strings"
+)
+
+// TargetForm is one of the four request-target forms of RFC 9112 section 3.2.
+type TargetForm int
+
+const (
+	OriginForm TargetForm = iota
+	AbsoluteForm
+	AuthorityForm
+	AsteriskForm
+)
+
+var ERROR_INVALID_TARGET = errors.New("Error request target is invalid")
+var ERROR_UNSAFE_ENCODING = errors.New("Error request target contains an unsafe percent-encoding")
+
+// URL is the parsed view of a request target. Path is percent-decoded while
+// RawPath keeps the bytes the client sent.
+type URL struct {
+	Form     TargetForm
+	Scheme   string
+	Host     string
+	Path     string
+	RawPath  string
+	RawQuery string
+	Query    Values
+}
+
+// Values holds query parameters. A key repeated in the query keeps every
+// value in the order it was sent.
+type Values map[string][]string
+
+func (v Values) Get(key string) string {
+	vals := v[key]
+	if len(vals) == 0 {
+		return ""
+	}
+
+	return vals[0]
+}
+
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// EscapedPath returns Path percent-encoded in its canonical form.
+func (u *URL) EscapedPath() string {
+	var sb strings.Builder
+	for i := 0; i < len(u.Path); i++ {
+		c := u.Path[i]
+		if isPathChar(c) {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(upperHex[c>>4])
+		sb.WriteByte(upperHex[c&0xF])
+	}
+
+	return sb.String()
+}
+
+// RequestURI returns the target the way it was sent for origin-form.
+func (u *URL) RequestURI() string {
+	if u.RawQuery == "" {
+		return u.RawPath
+	}
+
+	return u.RawPath + "?" + u.RawQuery
+}
+
+const upperHex = "0123456789ABCDEF"
+
+func parseTarget(method string, target string) (*URL, error) {
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		if c <= ' ' || c >= 0x7F || strings.IndexByte("#\"<>\\^`{|}", c) != -1 {
+			return nil, ERROR_INVALID_TARGET
+		}
+	}
+
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, ERROR_INVALID_TARGET
+		}
+		return &URL{Form: AsteriskForm, Path: "*", RawPath: "*", Query: Values{}}, nil
+
+	case method == "CONNECT":
+		if !isAuthority(target) {
+			return nil, ERROR_INVALID_TARGET
+		}
+		return &URL{Form: AuthorityForm, Host: target, Query: Values{}}, nil
+
+	case strings.HasPrefix(target, "/"):
+		return parseOriginForm(target)
+	}
+
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isScheme(scheme) {
+		return nil, ERROR_INVALID_TARGET
+	}
+
+	host := rest
+	pathAndQuery := "/"
+	if idx := strings.IndexAny(rest, "/?"); idx != -1 {
+		host = rest[:idx]
+		pathAndQuery = rest[idx:]
+		if pathAndQuery[0] == '?' {
+			pathAndQuery = "/" + pathAndQuery
+		}
+	}
+	if host == "" || strings.Contains(host, "@") {
+		return nil, ERROR_INVALID_TARGET
+	}
+
+	url, err := parseOriginForm(pathAndQuery)
+	if err != nil {
+		return nil, err
+	}
+	url.Form = AbsoluteForm
+	url.Scheme = strings.ToLower(scheme)
+	url.Host = host
+
+	return url, nil
+}
+
+func parseOriginForm(target string) (*URL, error) {
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	rawPath = removeDotSegments(rawPath)
+
+	path, err := unescape(rawPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Literal dot segments are gone, so any left were percent-encoded to get
+	// past that and must not be able to climb out of the path.
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return nil, ERROR_UNSAFE_ENCODING
+		}
+	}
+
+	query, err := parseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &URL{
+		Form:     OriginForm,
+		Path:     path,
+		RawPath:  rawPath,
+		RawQuery: rawQuery,
+		Query:    query,
+	}, nil
+}
+
+// removeDotSegments resolves "." and ".." segments the way RFC 3986, section
+// 5.2.4 does, so "/a/./b/../c" becomes "/a/c". ".." never climbs above the
+// root, and a path ending in a dot segment keeps its trailing slash.
+func removeDotSegments(path string) string {
+	segments := strings.Split(path, "/")
+	kept := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		switch segment {
+		case ".":
+		case "..":
+			if len(kept) > 1 {
+				kept = kept[:len(kept)-1]
+			}
+		default:
+			kept = append(kept, segment)
+			continue
+		}
+
+		if i == len(segments)-1 {
+			kept = append(kept, "")
+		}
+	}
+
+	return strings.Join(kept, "/")
+}
+
+func parseQuery(rawQuery string) (Values, error) {
+	query := Values{}
+	if rawQuery == "" {
+		return query, nil
+	}
+
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return nil, err
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			return nil, err
+		}
+
+		query[key] = append(query[key], value)
+	}
+
+	return query, nil
+}
+
+// unescape decodes percent-encoded octets. In a path, encodings that would
+// change how the path is split or that decode to control bytes are rejected.
+func unescape(s string, isQuery bool) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", ERROR_INVALID_TARGET
+			}
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if !isQuery && (decoded < ' ' || decoded == 0x7F || decoded == '/' || decoded == '\\') {
+				return "", ERROR_UNSAFE_ENCODING
+			}
+			sb.WriteByte(decoded)
+			i += 2
+		case c == '+' && isQuery:
+			sb.WriteByte(' ')
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+
+	return c - 'A' + 10
+}
+
+func isPathChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("-._~!$&'()*+,;=:@/", c) != -1
+}
+
+func isScheme(s string) bool {
+	if s == "" || !('a' <= s[0] && s[0] <= 'z' || 'A' <= s[0] && s[0] <= 'Z') {
+		return false
+	}
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isAuthority checks the host:port form CONNECT requests use.
+func isAuthority(s string) bool {
+	idx := strings.LastIndexByte(s, ':')
+	if idx <= 0 || idx == len(s)-1 || strings.ContainsAny(s, "/?@") {
+		return false
+	}
+
+	for _, c := range s[idx+1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
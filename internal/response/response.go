@@ -5,18 +5,12 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
 )
 
-type StatusCode int
-
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
-)
-
 type StatusWriter int
 
 const (
@@ -24,39 +18,133 @@ const (
 	WritingHeaders
 	WritingBody
 	WritingTrailers
+	WritingDone
 )
 
 type Writer struct {
 	writer        io.Writer
 	writingStatus StatusWriter
+	keepAlive     bool
+	head          bool
+	statusCode    StatusCode
+	headers       *headers.Headers
+	contentLength int
+	chunked       bool
+	bodyWritten   int
+}
+
+// ResponseWriter is what handlers write their response through. *Writer is
+// the implementation the server hands out; a middleware can wrap it in its
+// own type to watch or change what the handler writes, e.g. to compress the
+// body, and pass the wrapper on to the inner handler.
+type ResponseWriter interface {
+	WriteStatusLine(statusCode StatusCode) error
+	WriteInformational(statusCode StatusCode, hdrs *headers.Headers) error
+	WriteHeaders(hdrs *headers.Headers) error
+	WriteBody(p []byte) (int, error)
+	WriteChunkedBody(p []byte) (int, error)
+	WriteChunkedBodyDone() (int, error)
+	WriteTrailers(h *headers.Headers) error
+
+	StatusCode() StatusCode
+	Headers() *headers.Headers
+	BytesWritten() int
+	IsHead() bool
+	Started() bool
 }
 
+var _ ResponseWriter = (*Writer)(nil)
+
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		writer:        w,
 		writingStatus: WritingStatusLine,
+		contentLength: -1,
 	}
 }
 
+// SetKeepAlive tells the writer whether the connection stays open after this
+// response. It decides the Connection header written by WriteHeaders.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// KeepAlive reports whether the connection can be reused after this response.
+// It turns false when the handler sends "Connection: close" itself.
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive
+}
+
+// SetHead makes the writer answer a HEAD request: the status line and
+// headers are written as for GET, and body and trailers are dropped.
+func (w *Writer) SetHead(head bool) {
+	w.head = head
+}
+
+// IsHead reports whether the response is for a HEAD request, so a handler
+// can skip producing a body nobody will receive.
+func (w *Writer) IsHead() bool {
+	return w.head
+}
+
+// StatusCode returns the status written so far, or 0 before WriteStatusLine.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// Headers returns the header fields passed to WriteHeaders, or nil before.
+func (w *Writer) Headers() *headers.Headers {
+	return w.headers
+}
+
+// BytesWritten returns how many body bytes were sent, not counting chunk
+// framing or trailers. It stays 0 for HEAD.
+func (w *Writer) BytesWritten() int {
+	return w.bodyWritten
+}
+
+// Started reports whether the status line has been written, after which the
+// response can no longer be replaced by an error response.
+func (w *Writer) Started() bool {
+	return w.writingStatus != WritingStatusLine
+}
+
+// Complete reports whether a fully framed response has been written, so the
+// next response on the same connection can't be confused with this one.
+func (w *Writer) Complete() bool {
+	switch {
+	case w.writingStatus == WritingDone:
+		return true
+	case w.writingStatus != WritingBody:
+		return false
+	case w.head || !hasBody(w.statusCode):
+		return true
+	case w.chunked:
+		return false
+	case w.contentLength >= 0:
+		return w.bodyWritten == w.contentLength
+	}
+
+	return false
+}
+
+func hasBody(statusCode StatusCode) bool {
+	return statusCode >= 200 && statusCode != StatusNoContent && statusCode != StatusNotModified
+}
+
 const chunkSize = 10
 
 var ERROR_LEN_MISSMATCH = errors.New("Error writing len mismatch")
 var ERROR_WRITING_MISMATCH = errors.New("Error writing response in bad order")
+var ERROR_INVALID_STATUS_CODE = errors.New("Error status code outside 100-599")
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	statusLine := []byte("HTTP/1.1 ")
-	switch statusCode {
-	case StatusOK:
-		statusLine = fmt.Appendf(statusLine, "%d OK\r\n", statusCode)
-	case StatusBadRequest:
-		statusLine = fmt.Appendf(statusLine, "%d Bad Request\r\n", statusCode)
-	case StatusInternalServerError:
-		statusLine = fmt.Appendf(statusLine, "%d Internal Server Error\r\n", statusCode)
-	default:
-		statusLine = fmt.Appendf(nil, "HTTP/1.1 %d\r\n", statusCode)
-	}
-
-	_, err := w.Write(statusLine)
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(line)
 	if err != nil {
 		return fmt.Errorf("Error while writing to writer: %w", err)
 	}
@@ -64,18 +152,23 @@ func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
 	return nil
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	hdrs := headers.NewHeaders()
 	hdrs.Set("Content-Length", strconv.Itoa(contentLen))
-	hdrs.Set("Connection", "close")
+	hdrs.Set("Connection", "keep-alive")
 	hdrs.Set("Content-Type", "text/plain")
+	hdrs.SetDate(time.Now())
 
 	return hdrs
 }
 
-func WriteHeaders(w io.Writer, hdrs headers.Headers) error {
+func WriteHeaders(w io.Writer, hdrs *headers.Headers) error {
+	if err := hdrs.Validate(); err != nil {
+		return err
+	}
+
 	headersData := []byte{}
-	for headerKey, headerVal := range hdrs {
+	for headerKey, headerVal := range hdrs.All() {
 		headersData = fmt.Appendf(headersData, "%s: %s\r\n", headerKey, headerVal)
 	}
 	headersData = fmt.Append(headersData, "\r\n")
@@ -105,39 +198,97 @@ func WriteBody(w io.Writer, data []byte) error {
 	return nil
 }
 
+// WriteStatusLine writes the final status line. Interim 1xx responses go
+// through WriteInformational instead.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.writingStatus != WritingStatusLine {
 		return ERROR_WRITING_MISMATCH
 	}
+	if statusCode.IsInformational() {
+		return fmt.Errorf("%w: %d is informational, use WriteInformational", ERROR_INVALID_STATUS_CODE, statusCode)
+	}
 
-	statusLine := []byte("HTTP/1.1 ")
-	switch statusCode {
-	case StatusOK:
-		statusLine = fmt.Appendf(statusLine, "%d OK\r\n", statusCode)
-	case StatusBadRequest:
-		statusLine = fmt.Appendf(statusLine, "%d Bad Request\r\n", statusCode)
-	case StatusInternalServerError:
-		statusLine = fmt.Appendf(statusLine, "%d Internal Server Error\r\n", statusCode)
-	default:
-		statusLine = fmt.Appendf(nil, "HTTP/1.1 %d\r\n", statusCode)
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
 	}
 
 	w.writingStatus = WritingHeaders
-	_, err := w.writer.Write(statusLine)
+	w.statusCode = statusCode
+	_, err = w.writer.Write(line)
 	if err != nil {
 		return fmt.Errorf("Error while writing statusLine: %w", err)
 	}
 	return nil
 }
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+
+// WriteInformational sends an interim 1xx response, such as 100 Continue,
+// ahead of the final one. It can be called any number of times before
+// WriteStatusLine.
+func (w *Writer) WriteInformational(statusCode StatusCode, hdrs *headers.Headers) error {
+	if w.writingStatus != WritingStatusLine {
+		return ERROR_WRITING_MISMATCH
+	}
+	if !statusCode.IsInformational() {
+		return fmt.Errorf("%w: %d is not informational", ERROR_INVALID_STATUS_CODE, statusCode)
+	}
+	if err := hdrs.Validate(); err != nil {
+		return err
+	}
+
+	data, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	for headerKey, headerVal := range hdrs.All() {
+		data = fmt.Appendf(data, "%s: %s\r\n", headerKey, headerVal)
+	}
+	data = fmt.Append(data, "\r\n")
+
+	_, err = w.writer.Write(data)
+	if err != nil {
+		return fmt.Errorf("Error while writing informational response: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Writer) WriteHeaders(headers *headers.Headers) error {
 	if w.writingStatus != WritingHeaders {
 		return ERROR_WRITING_MISMATCH
 	}
+	if err := headers.Validate(); err != nil {
+		return err
+	}
+
+	if hasToken(headers, "Connection", "close") {
+		w.keepAlive = false
+	}
+	if contentLength, ok, err := headers.ContentLength(); ok && err == nil {
+		w.contentLength = int(contentLength)
+	}
+	w.chunked = hasToken(headers, "Transfer-Encoding", "chunked")
+	w.headers = headers
+
+	connection := connectionValue(headers, w.keepAlive)
 
+	// Connection reflects the writer's keep-alive decision and is written once,
+	// where the handler put it or last if it didn't.
 	headersData := []byte{}
-	for headerKey, headerVal := range headers {
+	wroteConnection := false
+	for headerKey, headerVal := range headers.All() {
+		if strings.EqualFold(headerKey, "Connection") {
+			if !wroteConnection {
+				headersData = fmt.Appendf(headersData, "%s: %s\r\n", headerKey, connection)
+				wroteConnection = true
+			}
+			continue
+		}
 		headersData = fmt.Appendf(headersData, "%s: %s\r\n", headerKey, headerVal)
 	}
+	if !wroteConnection {
+		headersData = fmt.Appendf(headersData, "Connection: %s\r\n", connection)
+	}
 	headersData = fmt.Append(headersData, "\r\n")
 
 	w.writingStatus = WritingBody
@@ -156,18 +307,32 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.writingStatus != WritingBody {
 		return 0, ERROR_WRITING_MISMATCH
 	}
-	return w.writer.Write(p)
+	if w.head {
+		return len(p), nil
+	}
+
+	n, err := w.writer.Write(p)
+	w.bodyWritten += n
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.writingStatus != WritingBody {
 		return 0, ERROR_WRITING_MISMATCH
 	}
+	if len(p) == 0 {
+		// An empty chunk would be read as the end of the body.
+		return 0, nil
+	}
+	if w.head {
+		return len(p), nil
+	}
 	_, err := w.writer.Write(fmt.Appendf(nil, "%X\r\n", len(p)))
 	if err != nil {
 		return 0, err
 	}
-	_, err = w.writer.Write(p)
+	n, err := w.writer.Write(p)
+	w.bodyWritten += n
 	if err != nil {
 		return 0, err
 	}
@@ -184,25 +349,37 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, ERROR_WRITING_MISMATCH
 	}
 
-	data := []byte("0\r\n")
+	w.writingStatus = WritingTrailers
+	if w.head {
+		return 0, nil
+	}
 
+	data := []byte("0\r\n")
 	numBytesWritten, err := w.writer.Write(data)
-	w.writingStatus = WritingTrailers
 
 	return numBytesWritten, err
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	if w.writingStatus != WritingTrailers {
 		return ERROR_WRITING_MISMATCH
 	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	if w.head {
+		w.writingStatus = WritingDone
+		return nil
+	}
 
 	trailersData := []byte{}
-	for trailerKey, trailerVal := range h {
+	for trailerKey, trailerVal := range h.All() {
 		trailersData = fmt.Appendf(trailersData, "%s: %s\r\n", trailerKey, trailerVal)
 	}
 	trailersData = fmt.Append(trailersData, "\r\n")
 
+	w.writingStatus = WritingDone
 	numBytesWritten, err := w.writer.Write(trailersData)
 	if err != nil {
 		return fmt.Errorf("Error while writing into writer: %w", err)
@@ -214,3 +391,60 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 
 	return nil
 }
+
+// Finish terminates a chunked body whose handler didn't write any trailers.
+func (w *Writer) Finish() error {
+	if w.writingStatus != WritingTrailers {
+		return nil
+	}
+
+	w.writingStatus = WritingDone
+	if w.head {
+		return nil
+	}
+
+	_, err := w.writer.Write([]byte("\r\n"))
+	if err != nil {
+		return fmt.Errorf("Error while writing into writer: %w", err)
+	}
+
+	return nil
+}
+
+// connectionValue keeps the handler's Connection tokens, such as upgrade or
+// the names of hop-by-hop fields, and ends them with keep-alive or close
+// in place of any the handler set.
+func connectionValue(hdrs *headers.Headers, keepAlive bool) string {
+	tokens := []string{}
+	for _, val := range hdrs.Values("Connection") {
+		for _, part := range strings.Split(val, ",") {
+			token := strings.TrimSpace(part)
+			if token == "" || strings.EqualFold(token, "keep-alive") || strings.EqualFold(token, "close") {
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+	}
+
+	if keepAlive {
+		tokens = append(tokens, "keep-alive")
+	} else {
+		tokens = append(tokens, "close")
+	}
+	return strings.Join(tokens, ", ")
+}
+
+func hasToken(hdrs *headers.Headers, key string, token string) bool {
+	val, ok := hdrs.Get(key)
+	if !ok {
+		return false
+	}
+
+	for _, part := range strings.Split(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,148 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadResponse(t *testing.T) {
+	// Test: Body dropped, Content-Length kept
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetHead(true)
+	require.True(t, w.IsHead())
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	assert.True(t, w.Complete())
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 0, w.BytesWritten())
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+
+	// Test: Chunks and trailers dropped
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetHead(true)
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(hdrs))
+	headerBlock := buf.String()
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, headerBlock, buf.String())
+	assert.True(t, w.Complete())
+}
+
+func TestConnectionHeader(t *testing.T) {
+	// Test: Other tokens survive, keep-alive is added
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	hdrs := GetDefaultHeaders(0)
+	hdrs.Set("Connection", "Upgrade")
+	hdrs.Set("Upgrade", "websocket")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(hdrs))
+	assert.Contains(t, buf.String(), "Connection: Upgrade, keep-alive\r\n")
+
+	// Test: The handler's keep-alive is replaced by close, once
+	buf.Reset()
+	w = NewWriter(buf)
+	hdrs = GetDefaultHeaders(0)
+	hdrs.Add("Connection", "keep-alive, X-Trace")
+	hdrs.Add("Connection", "upgrade")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(hdrs))
+	assert.Contains(t, buf.String(), "Connection: X-Trace, upgrade, close\r\n")
+	assert.Equal(t, 1, strings.Count(buf.String(), "Connection:"))
+
+	// Test: A close token from the handler ends keep-alive
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	hdrs = GetDefaultHeaders(0)
+	hdrs.Set("Connection", "close")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(hdrs))
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.False(t, w.KeepAlive())
+}
+
+func TestInformationalResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	// Test: Interim responses before the final one
+	require.NoError(t, w.WriteInformational(StatusContinue, nil))
+	hints := headers.NewHeaders()
+	hints.Set("Link", "</style.css>; rel=preload")
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, hints))
+	assert.False(t, w.Started())
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\nHTTP/1.1 204 No Content\r\n", buf.String())
+
+	// Test: Not after the final status line
+	err := w.WriteInformational(StatusContinue, nil)
+	require.ErrorIs(t, err, ERROR_WRITING_MISMATCH)
+
+	// Test: Only 1xx codes
+	err = NewWriter(buf).WriteInformational(StatusOK, nil)
+	require.ErrorIs(t, err, ERROR_INVALID_STATUS_CODE)
+
+	// Test: 1xx isn't a final status
+	buf.Reset()
+	w = NewWriter(buf)
+	err = w.WriteStatusLine(StatusContinue)
+	require.ErrorIs(t, err, ERROR_INVALID_STATUS_CODE)
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+}
+
+func TestHeaderInjection(t *testing.T) {
+	// Test: Value with CRLF is refused before anything is written
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	statusLine := buf.String()
+	hdrs := GetDefaultHeaders(0)
+	hdrs.Set("Location", "/next\r\nSet-Cookie: admin=1")
+	err := w.WriteHeaders(hdrs)
+	require.ErrorIs(t, err, headers.ERROR_INVALID_VALUE)
+	var ferr *headers.FieldError
+	require.ErrorAs(t, err, &ferr)
+	assert.Equal(t, "Location", ferr.Name)
+	assert.Equal(t, statusLine, buf.String())
+	assert.False(t, w.Complete())
+
+	// Test: Name that would end the field early
+	hdrs = headers.NewHeaders()
+	hdrs.Set("X-Name: a\r\nX-Other", "b")
+	require.ErrorIs(t, w.WriteHeaders(hdrs), headers.ERROR_INVALID_HEADER_FORMAT)
+
+	// Test: NUL in a trailer
+	buf.Reset()
+	w = NewWriter(buf)
+	hdrs = headers.NewHeaders()
+	hdrs.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(hdrs))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc\x00")
+	require.ErrorIs(t, w.WriteTrailers(trailers), headers.ERROR_INVALID_VALUE)
+}
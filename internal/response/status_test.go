@@ -0,0 +1,49 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered code gets its reason phrase
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	err := w.WriteStatusLine(StatusTooManyRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 429 Too Many Requests\r\n", buf.String())
+	assert.Equal(t, StatusTooManyRequests, w.StatusCode())
+
+	// Test: Unregistered code keeps the separator before the empty phrase
+	buf.Reset()
+	err = WriteStatusLine(buf, StatusCode(299))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+
+	// Test: Codes outside 100-599 are rejected
+	for _, code := range []StatusCode{0, 99, 600, 1000} {
+		buf.Reset()
+		w = NewWriter(buf)
+		err = w.WriteStatusLine(code)
+		require.ErrorIs(t, err, ERROR_INVALID_STATUS_CODE)
+		assert.Empty(t, buf.String())
+		assert.False(t, w.Started())
+	}
+}
+
+func TestStatusClasses(t *testing.T) {
+	assert.Equal(t, "Content Too Large", StatusText(StatusContentTooLarge))
+	assert.Equal(t, "", StatusText(StatusCode(299)))
+
+	assert.True(t, StatusEarlyHints.IsInformational())
+	assert.True(t, StatusNoContent.IsSuccess())
+	assert.True(t, StatusPermanentRedirect.IsRedirect())
+	assert.True(t, StatusNotFound.IsClientError())
+	assert.True(t, StatusBadGateway.IsServerError())
+	assert.False(t, StatusOK.IsClientError())
+	assert.False(t, StatusCode(600).IsServerError())
+	assert.False(t, StatusCode(600).Valid())
+}
@@ -0,0 +1,228 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/arnicfil/go_learn_http_protocol/internal/server"
+)
+
+type segmentKind int
+
+// Ordered from least to most specific, so the best route has the highest
+// kinds from left to right.
+const (
+	wildcardSegment segmentKind = iota
+	paramSegment
+	literalSegment
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type route struct {
+	method   string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests by method and path pattern. A pattern segment
+// written as {name} captures one path segment, and a final {name...} captures
+// the rest of the path.
+type Router struct {
+	routes   []*route
+	NotFound server.Handler
+}
+
+var ERROR_INVALID_PATTERN = errors.New("Error route pattern is invalid")
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers h for method and pattern. It panics on a malformed or
+// duplicate pattern, since routes are registered once at startup.
+func (rt *Router) Handle(method string, pattern string, h server.Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("%v: %q", err, pattern))
+	}
+
+	for _, r := range rt.routes {
+		if r.method == method && sameShape(r.segments, segments) {
+			panic(fmt.Sprintf("Error route %s %s registered twice", method, pattern))
+		}
+	}
+
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		segments: segments,
+		handler:  h,
+	})
+}
+
+// Handler returns the server.Handler that dispatches to the registered routes.
+func (rt *Router) Handler() server.Handler {
+	return rt.serve
+}
+
+func (rt *Router) serve(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+	path := req.RequestLine.RequestTarget
+	if req.URL != nil {
+		path = req.URL.Path
+	}
+
+	var best *route
+	var bestParams map[string]string
+	allowed := []string{}
+	for _, r := range rt.routes {
+		params, ok := r.match(path)
+		if !ok {
+			continue
+		}
+
+		if !slices.Contains(allowed, r.method) {
+			allowed = append(allowed, r.method)
+		}
+		if !r.serves(req.RequestLine.Method) {
+			continue
+		}
+		// A route registered for HEAD itself beats the GET route it would
+		// otherwise fall back to.
+		if best == nil || moreSpecific(r, best) ||
+			(sameShape(r.segments, best.segments) && r.method == req.RequestLine.Method) {
+			best, bestParams = r, params
+		}
+	}
+	if slices.Contains(allowed, "GET") && !slices.Contains(allowed, "HEAD") {
+		allowed = append(allowed, "HEAD")
+	}
+
+	if best != nil {
+		req.Params = bestParams
+		return best.handler(w, req)
+	}
+
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		hdrs := headers.NewHeaders()
+		hdrs.Set("Allow", strings.Join(allowed, ", "))
+		return &server.HandlerError{
+			StatusCode: response.StatusMethodNotAllowed,
+			Message:    *bytes.NewBufferString("Method Not Allowed"),
+			Headers:    hdrs,
+		}
+	}
+
+	if rt.NotFound != nil {
+		return rt.NotFound(w, req)
+	}
+
+	return &server.HandlerError{
+		StatusCode: response.StatusNotFound,
+		Message:    *bytes.NewBufferString("Not Found"),
+	}
+}
+
+// serves reports whether the route answers method. GET routes answer HEAD
+// too, the server drops the body they write.
+func (r *route) serves(method string) bool {
+	return r.method == method || (method == "HEAD" && r.method == "GET")
+}
+
+func (r *route) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := map[string]string{}
+
+	for i, seg := range r.segments {
+		if seg.kind == wildcardSegment {
+			params[seg.value] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case literalSegment:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case paramSegment:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[seg.value] = parts[i]
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+func moreSpecific(a *route, b *route) bool {
+	for i := 0; i < len(a.segments) && i < len(b.segments); i++ {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind > b.segments[i].kind
+		}
+	}
+
+	return len(a.segments) > len(b.segments)
+}
+
+// sameShape reports whether two patterns match exactly the same paths.
+func sameShape(a []segment, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x segment, y segment) bool {
+		return x.kind == y.kind && (x.kind != literalSegment || x.value == y.value)
+	})
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, ERROR_INVALID_PATTERN
+	}
+
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	names := map[string]bool{}
+
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, ERROR_INVALID_PATTERN
+			}
+			segments = append(segments, segment{kind: literalSegment, value: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		kind := paramSegment
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, ERROR_INVALID_PATTERN
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = wildcardSegment
+		}
+
+		if name == "" || names[name] {
+			return nil, ERROR_INVALID_PATTERN
+		}
+		names[name] = true
+
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+
+	return segments, nil
+}
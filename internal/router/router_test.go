@@ -0,0 +1,112 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/arnicfil/go_learn_http_protocol/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	matched := ""
+	named := func(name string) server.Handler {
+		return func(w response.ResponseWriter, req *request.Request) *server.HandlerError {
+			matched = name
+			return nil
+		}
+	}
+
+	rt := New()
+	rt.Handle("GET", "/users/{id}", named("user"))
+	rt.Handle("GET", "/users/me", named("me"))
+	rt.Handle("DELETE", "/users/{id}", named("delete"))
+	rt.Handle("GET", "/static/{path...}", named("static"))
+	rt.Handle("GET", "/", named("root"))
+	handler := rt.Handler()
+
+	// Test: Path parameter
+	req := newRequest(t, "GET /users/42 HTTP/1.1\r\n\r\n")
+	herr := handler(response.NewWriter(&bytes.Buffer{}), req)
+	require.Nil(t, herr)
+	assert.Equal(t, "user", matched)
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: Literal segment wins over a parameter
+	req = newRequest(t, "GET /users/me HTTP/1.1\r\n\r\n")
+	require.Nil(t, handler(response.NewWriter(&bytes.Buffer{}), req))
+	assert.Equal(t, "me", matched)
+
+	// Test: Method picks the route
+	req = newRequest(t, "DELETE /users/42 HTTP/1.1\r\n\r\n")
+	require.Nil(t, handler(response.NewWriter(&bytes.Buffer{}), req))
+	assert.Equal(t, "delete", matched)
+
+	// Test: Wildcard captures the decoded rest of the path
+	req = newRequest(t, "GET /static/css/site%20main.css HTTP/1.1\r\n\r\n")
+	require.Nil(t, handler(response.NewWriter(&bytes.Buffer{}), req))
+	assert.Equal(t, "static", matched)
+	assert.Equal(t, "css/site main.css", req.PathValue("path"))
+
+	// Test: Root
+	req = newRequest(t, "GET / HTTP/1.1\r\n\r\n")
+	require.Nil(t, handler(response.NewWriter(&bytes.Buffer{}), req))
+	assert.Equal(t, "root", matched)
+
+	// Test: Unknown path
+	req = newRequest(t, "GET /nothing/here HTTP/1.1\r\n\r\n")
+	herr = handler(response.NewWriter(&bytes.Buffer{}), req)
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: Empty parameter doesn't match
+	req = newRequest(t, "GET /users/ HTTP/1.1\r\n\r\n")
+	herr = handler(response.NewWriter(&bytes.Buffer{}), req)
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusNotFound, herr.StatusCode)
+
+	// Test: Wrong method lists the allowed ones
+	req = newRequest(t, "POST /users/42 HTTP/1.1\r\n\r\n")
+	herr = handler(response.NewWriter(&bytes.Buffer{}), req)
+	require.NotNil(t, herr)
+	assert.Equal(t, response.StatusMethodNotAllowed, herr.StatusCode)
+	allow, ok := herr.Headers.Get("Allow")
+	require.True(t, ok)
+	assert.Equal(t, "DELETE, GET, HEAD", allow)
+
+	// Test: HEAD falls back to the GET route
+	req = newRequest(t, "HEAD /users/42 HTTP/1.1\r\n\r\n")
+	herr = handler(response.NewWriter(&bytes.Buffer{}), req)
+	require.Nil(t, herr)
+	assert.Equal(t, "user", matched)
+
+	// Test: A HEAD route beats the GET route of the same pattern
+	rt.Handle("HEAD", "/users/{id}", named("head"))
+	req = newRequest(t, "HEAD /users/42 HTTP/1.1\r\n\r\n")
+	herr = handler(response.NewWriter(&bytes.Buffer{}), req)
+	require.Nil(t, herr)
+	assert.Equal(t, "head", matched)
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	rt := New()
+	noop := func(w response.ResponseWriter, req *request.Request) *server.HandlerError { return nil }
+
+	assert.Panics(t, func() { rt.Handle("GET", "users", noop) })
+	assert.Panics(t, func() { rt.Handle("GET", "/{path...}/more", noop) })
+	assert.Panics(t, func() { rt.Handle("GET", "/{id}/{id}", noop) })
+	assert.Panics(t, func() { rt.Handle("GET", "/a{b}", noop) })
+
+	rt.Handle("GET", "/users/{id}", noop)
+	assert.Panics(t, func() { rt.Handle("GET", "/users/{name}", noop) })
+}
+
+func newRequest(t *testing.T, raw string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+)
+
+// AccessLogFormat picks how WithAccessLog writes each request.
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon is the Common Log Format:
+	// host - - [time] "request line" status bytes
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined is the Common Log Format followed by the quoted
+	// Referer and User-Agent.
+	AccessLogCombined
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Keys of the attributes every access log record carries.
+const (
+	accessKeyRemoteAddr = "remote_addr"
+	accessKeyMethod     = "method"
+	accessKeyTarget     = "target"
+	accessKeyProto      = "proto"
+	accessKeyStatus     = "status"
+	accessKeyBytes      = "bytes"
+	accessKeyDuration   = "duration"
+	accessKeyUserAgent  = "user_agent"
+	accessKeyReferer    = "referer"
+)
+
+// newAccessLogger returns a logger that writes access log records to out in
+// format.
+func newAccessLogger(out io.Writer, format AccessLogFormat) *slog.Logger {
+	if format == AccessLogJSON {
+		return slog.New(slog.NewJSONHandler(out, nil))
+	}
+
+	return slog.New(&clfHandler{
+		mu:       &sync.Mutex{},
+		out:      out,
+		combined: format == AccessLogCombined,
+	})
+}
+
+// logAccess records one answered request. req is nil when the request
+// couldn't be read, in which case only the status is known.
+func (s *Server) logAccess(remoteAddr string, req *request.Request, w *response.Writer, start time.Time) {
+	if s.AccessLog == nil {
+		return
+	}
+
+	method, target, proto, userAgent, referer := "", "", "", "", ""
+	if req != nil {
+		remoteAddr = req.RemoteAddr
+		method = req.RequestLine.Method
+		target = req.RequestLine.RequestTarget
+		proto = "HTTP/" + req.RequestLine.HttpVersion
+		userAgent, _ = req.Headers.Get("User-Agent")
+		referer, _ = req.Headers.Get("Referer")
+	}
+
+	s.AccessLog.LogAttrs(context.Background(), slog.LevelInfo, "request",
+		slog.String(accessKeyRemoteAddr, remoteAddr),
+		slog.String(accessKeyMethod, method),
+		slog.String(accessKeyTarget, target),
+		slog.String(accessKeyProto, proto),
+		slog.Int(accessKeyStatus, int(w.StatusCode())),
+		slog.Int(accessKeyBytes, w.BytesWritten()),
+		slog.Duration(accessKeyDuration, time.Since(start)),
+		slog.String(accessKeyUserAgent, userAgent),
+		slog.String(accessKeyReferer, referer),
+	)
+}
+
+// clfHandler is a slog.Handler that lays out access log records in the
+// Common or Combined Log Format.
+type clfHandler struct {
+	mu       *sync.Mutex
+	out      io.Writer
+	combined bool
+	attrs    []slog.Attr
+}
+
+func (h *clfHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *clfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return &h2
+}
+
+func (h *clfHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+func (h *clfHandler) Handle(ctx context.Context, r slog.Record) error {
+	fields := make(map[string]string, len(h.attrs)+r.NumAttrs())
+	for _, attr := range h.attrs {
+		fields[attr.Key] = attr.Value.String()
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		fields[attr.Key] = attr.Value.String()
+		return true
+	})
+
+	requestLine := "-"
+	if fields[accessKeyMethod] != "" {
+		requestLine = strings.Join([]string{fields[accessKeyMethod], fields[accessKeyTarget], fields[accessKeyProto]}, " ")
+	}
+	size := fields[accessKeyBytes]
+	if size == "" || size == "0" {
+		size = "-"
+	}
+
+	host := fields[accessKeyRemoteAddr]
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+
+	line := fmt.Appendf(nil, "%s - - [%s] %s %s %s",
+		orDash(host), r.Time.Format(clfTimeFormat),
+		strconv.Quote(requestLine), orDash(fields[accessKeyStatus]), size)
+	if h.combined {
+		line = fmt.Appendf(line, " %s %s",
+			strconv.Quote(orDash(fields[accessKeyReferer])), strconv.Quote(orDash(fields[accessKeyUserAgent])))
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(line)
+	return err
+}
+
+func orDash(val string) string {
+	if val == "" {
+		return "-"
+	}
+
+	return val
+}
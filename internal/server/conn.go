@@ -0,0 +1,625 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+)
+
+// maxPipelinedRequests bounds how many requests of one connection may be
+// handled at once while their responses wait for their turn.
+const maxPipelinedRequests = 16
+
+// maxBufferedResponse bounds how much of a response is held in memory while
+// it waits for its turn. A handler that writes more is stalled until the
+// response reaches the front of the queue.
+const maxBufferedResponse = 64 << 10
+
+var ERROR_RESPONSE_DISCARDED = errors.New("Error response discarded because the connection is closing")
+var ERROR_BODY_NOT_REQUESTED = errors.New("Error request answered without asking for its body, connection can't be reused")
+
+// ConnState describes where a connection is in its life, as reported to the
+// WithConnState hook.
+type ConnState int
+
+const (
+	// StateNew is a connection that hasn't sent any bytes yet.
+	StateNew ConnState = iota
+	// StateActive is a connection with a request being read or answered.
+	StateActive
+	// StateIdle is a keep-alive connection waiting for its next request.
+	StateIdle
+	// StateClosed is a connection that has been closed.
+	StateClosed
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	}
+
+	return "unknown"
+}
+
+type conn struct {
+	server    *Server
+	netConn   net.Conn
+	out       io.Writer
+	parser    *request.Parser
+	responses chan *pipelinedResponse
+	closed    atomic.Bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	tlsState  *tls.ConnectionState
+
+	// bodyPending is set by the reader while a handler may still be reading
+	// a streaming body off the connection.
+	bodyPending bool
+
+	mu       sync.Mutex
+	state    ConnState
+	inFlight int
+	waiting  bool
+}
+
+func newConn(s *Server, netConn net.Conn) *conn {
+	var in io.Reader = netConn
+	var out io.Writer = netConn
+	if s.Metrics != nil {
+		in = meteredReader{Reader: netConn, metrics: s.Metrics}
+		out = meteredWriter{Writer: netConn, metrics: s.Metrics}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		server:    s,
+		netConn:   netConn,
+		out:       out,
+		parser:    request.NewParserWithLimits(in, s.Limits),
+		responses: make(chan *pipelinedResponse, maxPipelinedRequests),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// readRequests parses requests off the connection and starts a handler for
+// each one without waiting for earlier responses to be written.
+func (c *conn) readRequests() {
+	defer close(c.responses)
+
+	for numRequests := 1; ; numRequests++ {
+		req, err := c.readRequest(numRequests == 1)
+		if err != nil {
+			c.readFailed(nil, err)
+			return
+		}
+
+		keepAlive := !wantsClose(req) && !c.server.Closing.Load() &&
+			(c.server.MaxRequestsPerConn <= 0 || numRequests < c.server.MaxRequestsPerConn)
+		resp := c.queue(keepAlive, req)
+
+		if !c.server.StreamRequestBody {
+			if req.ExpectsContinue() {
+				// The client holds the body back until it is asked for it,
+				// which happens on the first read. The headers have already
+				// passed the framing and size checks by now.
+				cont := newTrackedBody(req.BodyReader)
+				cont.expectContinue(resp.writer)
+				req.BodyReader = cont
+			}
+			err = req.ReadBody()
+			if err != nil {
+				c.readFailed(resp, err)
+				return
+			}
+		}
+
+		// A body that is already parsed, or empty, is read from memory, so the
+		// connection is free for the next request or to watch for a hang-up.
+		c.bodyPending = c.server.StreamRequestBody && req.BodyPending()
+		body := newTrackedBody(req.BodyReader)
+		if c.server.StreamRequestBody && req.ExpectsContinue() {
+			body.expectContinue(resp.writer)
+		}
+		req.BodyReader = body
+		req.TLS = c.tlsState
+		req.RemoteAddr = c.netConn.RemoteAddr().String()
+		ctx, cancel := c.requestContext()
+		req = req.WithContext(ctx)
+
+		c.run(resp, req, func(w *response.Writer) {
+			defer cancel()
+			c.serve(w, req, body)
+		})
+
+		if !keepAlive {
+			return
+		}
+
+		if c.bodyPending {
+			// The next request starts where this body ends on the wire.
+			<-body.done
+			if body.err != nil {
+				return
+			}
+			c.bodyPending = false
+		}
+	}
+}
+
+// readFailed answers a request that couldn't be read, in the slot queued for
+// it if there is one. Nothing more is read from the connection after this.
+func (c *conn) readFailed(resp *pipelinedResponse, err error) {
+	if clientGone(err) {
+		// Nobody is left to read the answers to requests in flight.
+		c.cancel()
+	}
+
+	quiet := c.closed.Load() || errors.Is(err, request.ERROR_NO_REQUEST)
+	if resp == nil {
+		if quiet {
+			return
+		}
+		resp = c.queue(false, nil)
+	}
+	resp.writer.SetKeepAlive(false)
+
+	if quiet {
+		c.run(resp, nil, func(w *response.Writer) {})
+		return
+	}
+
+	c.server.Logger.Error("Error while reading request", "remote", c.netConn.RemoteAddr(), "err", err)
+	if c.server.Metrics != nil {
+		c.server.Metrics.ParseError(err)
+	}
+	c.run(resp, nil, func(w *response.Writer) {
+		c.server.writeError(w, nil, statusForError(err), err)
+	})
+}
+
+// watchForHangUp keeps reading after the last request so the requests still
+// being handled are cancelled if the client goes away. A streaming body may
+// still be in use by its handler, so the connection is left alone then.
+func (c *conn) watchForHangUp() {
+	if c.bodyPending {
+		return
+	}
+
+	c.netConn.SetReadDeadline(time.Time{})
+	err := c.parser.WaitForRequest()
+	if clientGone(err) {
+		c.cancel()
+	}
+}
+
+// readRequest reads a request up to its body and moves the read deadline
+// along as it arrives: the idle timeout while waiting for it to start, the
+// header timeout for the request line and headers, and the read timeout for
+// the whole request, body included.
+func (c *conn) readRequest(first bool) (*request.Request, error) {
+	s := c.server
+	waitTimeout := firstPositive(s.IdleTimeout, s.ReadTimeout)
+	if first {
+		waitTimeout = firstPositive(s.ReadHeaderTimeout, s.ReadTimeout)
+	}
+
+	if !first {
+		c.startWaiting()
+	}
+	c.netConn.SetReadDeadline(deadline(time.Now(), waitTimeout))
+	err := c.parser.WaitForRequest()
+	if err != nil {
+		return &request.Request{}, err
+	}
+	c.stopWaiting()
+
+	start := time.Now()
+	c.netConn.SetReadDeadline(deadline(start, firstPositive(s.ReadHeaderTimeout, s.ReadTimeout)))
+	req, err := c.parser.ReadStreamingRequest()
+	if err != nil {
+		return req, err
+	}
+
+	c.netConn.SetReadDeadline(deadline(start, s.ReadTimeout))
+	return req, nil
+}
+
+// requestContext derives a request's context from the connection's, bounded
+// by the handler timeout if there is one.
+func (c *conn) requestContext() (context.Context, context.CancelFunc) {
+	if c.server.HandlerTimeout > 0 {
+		return context.WithTimeout(c.ctx, c.server.HandlerTimeout)
+	}
+
+	return context.WithCancel(c.ctx)
+}
+
+// clientGone reports whether a read failed because the client hung up, as
+// opposed to a timeout or a malformed request.
+func clientGone(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &opErr)
+}
+
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+
+	return start.Add(timeout)
+}
+
+func firstPositive(timeouts ...time.Duration) time.Duration {
+	for _, timeout := range timeouts {
+		if timeout > 0 {
+			return timeout
+		}
+	}
+
+	return 0
+}
+
+// queue reserves the response slot of the next request, so its response is
+// written in request order.
+func (c *conn) queue(keepAlive bool, req *request.Request) *pipelinedResponse {
+	resp := newPipelinedResponse(c.out)
+	resp.writer.SetKeepAlive(keepAlive)
+	if req != nil {
+		resp.writer.SetHead(req.RequestLine.Method == "HEAD")
+	}
+
+	c.mu.Lock()
+	c.inFlight++
+	c.mu.Unlock()
+	c.responses <- resp
+
+	return resp
+}
+
+// run fills a queued response slot by calling fn in its own goroutine. A
+// panic in fn only affects this connection.
+func (c *conn) run(resp *pipelinedResponse, req *request.Request, fn func(w *response.Writer)) {
+	metrics := c.server.Metrics
+	if req == nil {
+		metrics = nil
+	}
+
+	start := time.Now()
+	go func() {
+		defer close(resp.done)
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				c.server.recoverPanic(resp.writer, req, recovered)
+			}
+			c.server.logAccess(c.netConn.RemoteAddr().String(), req, resp.writer, start)
+			if metrics != nil {
+				metrics.HandlerDone(req.RequestLine.Method, resp.writer.StatusCode(), time.Since(start))
+			}
+		}()
+		if metrics != nil {
+			metrics.HandlerStarted(req.RequestLine.Method)
+		}
+
+		fn(resp.writer)
+	}()
+}
+
+func (c *conn) serve(w *response.Writer, req *request.Request, body *trackedBody) {
+	// Let the reader move on even if the handler panics.
+	defer body.Close()
+
+	herr := c.server.HandlerFunc(w, req)
+	readErr := body.err
+	if err := body.Close(); err != nil {
+		w.SetKeepAlive(false)
+	}
+
+	var statusCode response.StatusCode
+	var cause error
+	if herr != nil {
+		statusCode, cause = herr.StatusCode, herr
+	} else if readErr != nil && !w.Started() {
+		// A streaming body turned out to be invalid before the handler answered.
+		statusCode, cause = statusForError(readErr), readErr
+		w.SetKeepAlive(false)
+		if c.server.Metrics != nil {
+			c.server.Metrics.ParseError(readErr)
+		}
+	}
+
+	if cause != nil {
+		err := c.server.writeError(w, req, statusCode, cause)
+		if err != nil {
+			c.server.Logger.Error("Error while returning error", "err", err)
+			return
+		}
+	}
+
+	err := w.Finish()
+	if err != nil {
+		c.server.Logger.Error("Error while finishing response", "err", err)
+	}
+}
+
+// writeResponses writes the queued responses in the order their requests
+// arrived. Once a response leaves the connection unusable, the remaining ones
+// are discarded and the connection is closed.
+func (c *conn) writeResponses() {
+	defer c.close()
+
+	for resp := range c.responses {
+		if c.closed.Load() {
+			resp.discard()
+			<-resp.done
+			c.responseDone()
+			continue
+		}
+
+		if c.server.WriteTimeout > 0 {
+			c.netConn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+		}
+
+		err := resp.flush()
+		<-resp.done
+		if err != nil || !resp.writer.KeepAlive() || !resp.writer.Complete() {
+			c.close()
+		}
+		c.responseDone()
+	}
+}
+
+func (c *conn) close() {
+	if c.closed.Swap(true) {
+		return
+	}
+	c.netConn.Close()
+	c.cancel()
+	c.setState(StateClosed)
+}
+
+// closeIfIdle closes the connection if it is between requests.
+func (c *conn) closeIfIdle() {
+	c.mu.Lock()
+	idle := c.state == StateNew || c.state == StateIdle
+	c.mu.Unlock()
+
+	if idle {
+		c.close()
+	}
+}
+
+func (c *conn) setState(state ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setStateLocked(state)
+}
+
+func (c *conn) setStateLocked(state ConnState) {
+	if c.state == StateClosed || (c.state == state && state != StateNew) {
+		return
+	}
+
+	c.state = state
+	if c.server.ConnState != nil {
+		c.server.ConnState(c.netConn, state)
+	}
+}
+
+// startWaiting marks the reader as waiting for the next request. The
+// connection is idle once no earlier response is still being written.
+func (c *conn) startWaiting() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waiting = true
+	if c.inFlight == 0 {
+		c.setStateLocked(StateIdle)
+	}
+}
+
+func (c *conn) stopWaiting() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waiting = false
+	c.setStateLocked(StateActive)
+}
+
+func (c *conn) responseDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight--
+	if c.inFlight == 0 && c.waiting {
+		c.setStateLocked(StateIdle)
+	}
+}
+
+// wantsClose reports whether the connection has to be closed after this
+// request. HTTP/1.0 clients close by default and have to ask for keep-alive
+// instead. An HTTP/1.0 request with Transfer-Encoding is closed regardless:
+// that version has no chunked framing, so whatever sent it may have framed
+// the body differently (RFC 9112, section 6.1).
+func wantsClose(req *request.Request) bool {
+	if req.RequestLine.HttpVersion == "1.0" {
+		if _, ok := req.Headers.Get("Transfer-Encoding"); ok {
+			return true
+		}
+		return !hasConnectionToken(req, "keep-alive")
+	}
+
+	return hasConnectionToken(req, "close")
+}
+
+func hasConnectionToken(req *request.Request, token string) bool {
+	val, ok := req.Headers.Get("Connection")
+	if !ok {
+		return false
+	}
+
+	for _, part := range strings.Split(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trackedBody tells the connection's reader when the handler is done with a
+// streaming body, so the next request can be parsed after it. For a client
+// that expects 100-continue it also sends the 100 Continue on the first read.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+	err  error
+
+	continueWriter *response.Writer
+	keepAlive      bool
+}
+
+func newTrackedBody(body io.ReadCloser) *trackedBody {
+	return &trackedBody{
+		ReadCloser: body,
+		done:       make(chan struct{}),
+	}
+}
+
+// expectContinue holds the body back until the handler reads it. Until then
+// the connection can't be reused: a handler that answers without reading
+// leaves the body unsent, or on its way, with no way to tell which.
+func (t *trackedBody) expectContinue(w *response.Writer) {
+	t.continueWriter = w
+	t.keepAlive = w.KeepAlive()
+	w.SetKeepAlive(false)
+}
+
+func (t *trackedBody) Read(p []byte) (int, error) {
+	if w := t.continueWriter; w != nil {
+		t.continueWriter = nil
+		if !w.Started() {
+			w.WriteInformational(response.StatusContinue, nil)
+			w.SetKeepAlive(t.keepAlive)
+		}
+	}
+
+	n, err := t.ReadCloser.Read(p)
+	if err != nil {
+		t.finish(err)
+	}
+
+	return n, err
+}
+
+func (t *trackedBody) Close() error {
+	if t.continueWriter != nil {
+		// The client was never asked for the body, so there's nothing to drain.
+		t.finish(ERROR_BODY_NOT_REQUESTED)
+		return ERROR_BODY_NOT_REQUESTED
+	}
+
+	err := t.ReadCloser.Close()
+	t.finish(err)
+
+	return err
+}
+
+func (t *trackedBody) finish(err error) {
+	t.once.Do(func() {
+		if err != io.EOF {
+			t.err = err
+		}
+		close(t.done)
+	})
+}
+
+// pipelinedResponse buffers what a handler writes until every earlier
+// response on the connection is done, then writes straight through. Past
+// maxBufferedResponse the handler's writes block until then instead.
+type pipelinedResponse struct {
+	mu        sync.Mutex
+	turn      *sync.Cond
+	out       io.Writer
+	buffer    bytes.Buffer
+	head      bool
+	discarded bool
+	done      chan struct{}
+	writer    *response.Writer
+}
+
+func newPipelinedResponse(out io.Writer) *pipelinedResponse {
+	resp := &pipelinedResponse{
+		out:  out,
+		done: make(chan struct{}),
+	}
+	resp.turn = sync.NewCond(&resp.mu)
+	resp.writer = response.NewWriter(resp)
+
+	return resp
+}
+
+func (p *pipelinedResponse) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.head && !p.discarded && p.buffer.Len()+len(data) > maxBufferedResponse {
+		p.turn.Wait()
+	}
+	if p.discarded {
+		return 0, ERROR_RESPONSE_DISCARDED
+	}
+	if p.head {
+		return p.out.Write(data)
+	}
+
+	return p.buffer.Write(data)
+}
+
+func (p *pipelinedResponse) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.head = true
+	p.turn.Broadcast()
+	_, err := p.out.Write(p.buffer.Bytes())
+	p.buffer.Reset()
+	if err != nil {
+		p.discarded = true
+	}
+
+	return err
+}
+
+func (p *pipelinedResponse) discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.discarded = true
+	p.turn.Broadcast()
+	p.buffer.Reset()
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+)
+
+// ErrorRenderer builds the body of an error response. err is either the
+// *HandlerError returned by a handler or the error that stopped the request
+// from being read, in which case req is nil.
+type ErrorRenderer func(req *request.Request, statusCode response.StatusCode, err error) (contentType string, body []byte)
+
+// PanicHook is told about every panic recovered from a handler, along with
+// the stack of the goroutine that panicked.
+type PanicHook func(req *request.Request, recovered any, stack []byte)
+
+var ERROR_HANDLER_PANIC = errors.New("Error handler panicked")
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("Handler error %d: %s", e.StatusCode, e.Message.String())
+}
+
+// errorPageTypes are the formats the default error page comes in. A client
+// that doesn't say which it wants, or accepts none of them, gets the first.
+var errorPageTypes = []string{"text/plain", "text/html", "application/json"}
+
+// Negotiate returns the offer req's Accept field prefers. When it accepts none
+// of them, the *HandlerError is a 406 for the handler to return.
+func Negotiate(req *request.Request, offers ...string) (string, *HandlerError) {
+	if contentType := req.Headers.Negotiate(offers); contentType != "" {
+		return contentType, nil
+	}
+
+	return "", &HandlerError{
+		StatusCode: response.StatusNotAcceptable,
+		Message:    *bytes.NewBufferString("Available: " + strings.Join(offers, ", ")),
+	}
+}
+
+// defaultErrorRenderer answers with the HandlerError's message, as plain text,
+// HTML or JSON depending on what the request accepts.
+func defaultErrorRenderer(req *request.Request, statusCode response.StatusCode, err error) (string, []byte) {
+	var message []byte
+	var herr *HandlerError
+	if errors.As(err, &herr) {
+		message = herr.Message.Bytes()
+	}
+
+	contentType := errorPageTypes[0]
+	if req != nil {
+		contentType = cmp.Or(req.Headers.Negotiate(errorPageTypes), contentType)
+	}
+
+	switch contentType {
+	case "text/html":
+		return "text/html; charset=utf-8", errorPageHTML(statusCode, message)
+	case "application/json":
+		return "application/json", errorPageJSON(statusCode, message)
+	}
+
+	return "text/plain", message
+}
+
+func errorPageHTML(statusCode response.StatusCode, message []byte) []byte {
+	text := html.EscapeString(response.StatusText(statusCode))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html>\n  <head>\n    <title>%d %s</title>\n  </head>\n  <body>\n    <h1>%s</h1>\n", statusCode, text, text)
+	if len(message) > 0 {
+		fmt.Fprintf(&b, "    <p>%s</p>\n", html.EscapeString(string(message)))
+	}
+	b.WriteString("  </body>\n</html>")
+
+	return []byte(b.String())
+}
+
+func errorPageJSON(statusCode response.StatusCode, message []byte) []byte {
+	body, _ := json.Marshal(struct {
+		Status  int    `json:"status"`
+		Error   string `json:"error"`
+		Message string `json:"message,omitempty"`
+	}{int(statusCode), response.StatusText(statusCode), string(message)})
+
+	return body
+}
+
+func statusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return response.StatusRequestTimeout
+	case errors.Is(err, request.ERROR_REQUEST_LINE_TOO_LONG):
+		return response.StatusURITooLong
+	case errors.Is(err, request.ERROR_HEADERS_TOO_LARGE), errors.Is(err, request.ERROR_TOO_MANY_HEADERS):
+		return response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+		return response.StatusContentTooLarge
+	case errors.Is(err, request.ERROR_METHOD_NOT_IMPLEMENTED), errors.Is(err, request.ERROR_UNSUPPORTED_TRANSFER_CODING):
+		return response.StatusNotImplemented
+	case errors.Is(err, request.ERROR_UNSUPPORTED_VERSION):
+		return response.StatusHTTPVersionNotSupported
+	case errors.Is(err, request.ERROR_EXPECTATION_FAILED):
+		return response.StatusExpectationFailed
+	}
+
+	return response.StatusBadRequest
+}
+
+func (s *Server) writeError(w *response.Writer, req *request.Request, statusCode response.StatusCode, err error) error {
+	renderer := s.ErrorRenderer
+	if renderer == nil {
+		renderer = defaultErrorRenderer
+	}
+	if !statusCode.Valid() {
+		// A HandlerError without a usable status still has to be answered.
+		statusCode = response.StatusInternalServerError
+	}
+
+	contentType, body := renderer(req, statusCode, err)
+
+	extra := headers.NewHeaders()
+	var herr *HandlerError
+	if errors.As(err, &herr) {
+		for name, val := range herr.Headers.All() {
+			extra.Add(name, val)
+		}
+	}
+	if s.ErrorRenderer == nil && req != nil {
+		addVary(extra, "Accept")
+	}
+
+	return writeResponse(w, statusCode, contentType, body, extra)
+}
+
+// addVary adds field to the Vary field of hdrs, merging it with the values
+// already there so the response carries a single Vary field.
+func addVary(hdrs *headers.Headers, field string) {
+	vary := []string{}
+	for _, val := range hdrs.Values("Vary") {
+		for _, part := range strings.Split(val, ",") {
+			token := strings.TrimSpace(part)
+			if token == "*" || strings.EqualFold(token, field) {
+				// Already varies on field, or on everything.
+				return
+			}
+			if token != "" {
+				vary = append(vary, token)
+			}
+		}
+	}
+
+	hdrs.Set("Vary", strings.Join(append(vary, field), ", "))
+}
+
+// recoverPanic answers a request whose handler panicked. A response that has
+// not started yet becomes a 500, otherwise the connection is cut after what
+// was already written so the client can tell the response is broken.
+func (s *Server) recoverPanic(w *response.Writer, req *request.Request, recovered any) {
+	stack := debug.Stack()
+	s.Logger.Error("Panic while serving request", "panic", recovered, "stack", string(stack))
+	if s.PanicHook != nil {
+		s.PanicHook(req, recovered, stack)
+	}
+
+	w.SetKeepAlive(false)
+	if w.Started() {
+		return
+	}
+
+	err := s.writeError(w, req, response.StatusInternalServerError, fmt.Errorf("%w: %v", ERROR_HANDLER_PANIC, recovered))
+	if err != nil {
+		s.Logger.Error("Error while returning error", "err", err)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+)
+
+// MetricsRecorder is told about everything the server does that is worth
+// counting. internal/metrics has an implementation that renders the counts
+// for Prometheus. Methods are called from many goroutines at once.
+type MetricsRecorder interface {
+	ConnAccepted()
+	ConnClosed()
+	// HandlerStarted and HandlerDone bracket every handler call.
+	HandlerStarted(method string)
+	HandlerDone(method string, statusCode response.StatusCode, duration time.Duration)
+	// ParseError is called for every request that couldn't be read.
+	ParseError(err error)
+	BytesRead(n int)
+	BytesWritten(n int)
+}
+
+// meteredReader counts the bytes read from a connection.
+type meteredReader struct {
+	io.Reader
+	metrics MetricsRecorder
+}
+
+func (m meteredReader) Read(p []byte) (int, error) {
+	n, err := m.Reader.Read(p)
+	m.metrics.BytesRead(n)
+	return n, err
+}
+
+// meteredWriter counts the bytes written to a connection.
+type meteredWriter struct {
+	io.Writer
+	metrics MetricsRecorder
+}
+
+func (m meteredWriter) Write(p []byte) (int, error) {
+	n, err := m.Writer.Write(p)
+	m.metrics.BytesWritten(n)
+	return n, err
+}
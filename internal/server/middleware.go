@@ -0,0 +1,18 @@
+package server
+
+// Middleware wraps a Handler with behavior that runs around it. After the
+// inner handler returns, a middleware can inspect what it wrote through
+// w.StatusCode, w.Headers and w.BytesWritten, or through the returned
+// *HandlerError if the server still has to write the response. To see or
+// change the output as it is written, it passes the inner handler its own
+// response.ResponseWriter wrapping w.
+type Middleware func(Handler) Handler
+
+// Chain wraps h in middlewares so that the first one runs outermost.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
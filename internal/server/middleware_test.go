@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gzipWriter compresses the body its handler writes into a chunked body.
+type gzipWriter struct {
+	response.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeaders(hdrs *headers.Headers) error {
+	hdrs.Del("Content-Length")
+	hdrs.Set("Content-Encoding", "gzip")
+	hdrs.Set("Transfer-Encoding", "chunked")
+	g.gz = gzip.NewWriter(chunkWriter{g.ResponseWriter})
+
+	return g.ResponseWriter.WriteHeaders(hdrs)
+}
+
+func (g *gzipWriter) WriteBody(p []byte) (int, error) {
+	return g.gz.Write(p)
+}
+
+func (g *gzipWriter) finish() error {
+	if g.gz == nil {
+		return nil
+	}
+	if err := g.gz.Close(); err != nil {
+		return err
+	}
+	_, err := g.ResponseWriter.WriteChunkedBodyDone()
+
+	return err
+}
+
+type chunkWriter struct {
+	w response.ResponseWriter
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.WriteChunkedBody(p)
+}
+
+func compress(next Handler) Handler {
+	return func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		gw := &gzipWriter{ResponseWriter: w}
+		if herr := next(gw, req); herr != nil {
+			return herr
+		}
+		if err := gw.finish(); err != nil {
+			return &HandlerError{StatusCode: response.StatusInternalServerError}
+		}
+
+		return nil
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w response.ResponseWriter, req *request.Request) *HandlerError {
+				calls = append(calls, name+" before")
+				herr := next(w, req)
+				calls = append(calls, name+" after")
+				return herr
+			}
+		}
+	}
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		calls = append(calls, "handler")
+		return nil
+	}
+
+	// Test: First middleware runs outermost
+	h := Chain(handler, trace("outer"), trace("inner"))
+	require.Nil(t, h(response.NewWriter(io.Discard), &request.Request{}))
+	assert.Equal(t, []string{"outer before", "inner before", "handler", "inner after", "outer after"}, calls)
+
+	// Test: No middlewares leaves the handler as it is
+	calls = nil
+	require.Nil(t, Chain(handler)(response.NewWriter(io.Discard), &request.Request{}))
+	assert.Equal(t, []string{"handler"}, calls)
+}
+
+func TestMiddlewareObservesResponse(t *testing.T) {
+	var status response.StatusCode
+	var written int
+	var contentType string
+	observe := func(next Handler) Handler {
+		return func(w response.ResponseWriter, req *request.Request) *HandlerError {
+			herr := next(w, req)
+			status, written = w.StatusCode(), w.BytesWritten()
+			contentType, _ = w.Headers().Get("Content-Type")
+			return herr
+		}
+	}
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		hdrs := response.GetDefaultHeaders(5)
+		hdrs.Set("Content-Type", "text/html")
+		w.WriteStatusLine(response.StatusCreated)
+		w.WriteHeaders(hdrs)
+		w.WriteBody([]byte("hello"))
+		return nil
+	}
+
+	// Test: Status, byte count and headers seen after the inner handler
+	buf := &bytes.Buffer{}
+	require.Nil(t, Chain(handler, observe)(response.NewWriter(buf), &request.Request{}))
+	assert.Equal(t, response.StatusCreated, status)
+	assert.Equal(t, 5, written)
+	assert.Equal(t, "text/html", contentType)
+}
+
+func TestMiddlewareWrapsWriter(t *testing.T) {
+	body := bytes.Repeat([]byte("compress me "), 100)
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+
+	// Test: Body is compressed on its way out through a wrapping writer
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	require.Nil(t, Chain(handler, compress)(w, &request.Request{}))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Complete())
+
+	out := buf.String()
+	assert.Contains(t, out, "Content-Encoding: gzip\r\n")
+	assert.Contains(t, out, "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, out, "Content-Length")
+
+	// Reuse the request parser to undo the chunked framing.
+	r, err := request.RequestFromReader(bytes.NewBufferString("POST / HTTP/1.1\r\n" + out[bytes.Index(buf.Bytes(), []byte("Content-Encoding")):]))
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(r.Body))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, body, decoded)
+}
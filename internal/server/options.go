@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+)
+
+// Option configures a Server before it starts accepting connections.
+type Option func(*Server)
+
+// WithIdleTimeout sets how long a keep-alive connection may wait for its next
+// request before the server closes it.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.IdleTimeout = timeout
+	}
+}
+
+// WithReadHeaderTimeout bounds the time from the first byte of a request to
+// the end of its headers. Zero falls back to the read timeout.
+func WithReadHeaderTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.ReadHeaderTimeout = timeout
+	}
+}
+
+// WithReadTimeout bounds the time from the first byte of a request to the end
+// of its body.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.ReadTimeout = timeout
+	}
+}
+
+// WithWriteTimeout bounds how long writing a single response may take.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.WriteTimeout = timeout
+	}
+}
+
+// WithHandlerTimeout cancels each request's context once timeout has passed
+// since its handler started. The handler is expected to notice and return.
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.HandlerTimeout = timeout
+	}
+}
+
+// WithMaxRequestsPerConn caps how many requests are served on one connection.
+func WithMaxRequestsPerConn(maxRequests int) Option {
+	return func(s *Server) {
+		s.MaxRequestsPerConn = maxRequests
+	}
+}
+
+// WithStreamingBody hands requests to the handler as soon as their headers are
+// parsed. The body is read from the connection through req.BodyReader, and
+// req.Body stays nil. It is also what lets a handler refuse a request that
+// expects 100-continue before the client sends the body: without it the
+// server reads the body, asking for it if needed, before the handler runs.
+// While a body is still being read off the connection, a client hanging up
+// doesn't cancel req.Context(): the handler finds out from its reads
+// failing instead.
+func WithStreamingBody() Option {
+	return func(s *Server) {
+		s.StreamRequestBody = true
+	}
+}
+
+// WithLimits bounds the size of the requests the server accepts. Requests
+// over a limit are answered with 414, 431 or 413.
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.Limits = limits
+	}
+}
+
+// WithTLSConfig serves every connection over TLS using a copy of cfg. It
+// replaces anything set by earlier WithCertificate or WithClientCAs options.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.TLSConfig = cfg.Clone()
+	}
+}
+
+// WithCertificate serves every connection over TLS, presenting cert.
+func WithCertificate(cert tls.Certificate) Option {
+	return func(s *Server) {
+		if s.TLSConfig == nil {
+			s.TLSConfig = &tls.Config{}
+		}
+		s.TLSConfig.Certificates = append(s.TLSConfig.Certificates, cert)
+	}
+}
+
+// WithClientCAs requires clients to present a certificate signed by one of
+// the CAs in pool (mutual TLS). It needs a certificate of the server's own.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(s *Server) {
+		if s.TLSConfig == nil {
+			s.TLSConfig = &tls.Config{}
+		}
+		s.TLSConfig.ClientCAs = pool
+		s.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+}
+
+// WithNetwork picks the network to listen on, e.g. "tcp6" to only accept
+// IPv6 connections.
+func WithNetwork(network string) Option {
+	return func(s *Server) {
+		s.Network = network
+	}
+}
+
+// WithErrorRenderer replaces the plain text error pages written by the server.
+func WithErrorRenderer(renderer ErrorRenderer) Option {
+	return func(s *Server) {
+		s.ErrorRenderer = renderer
+	}
+}
+
+// WithPanicHook reports recovered handler panics to hook, e.g. to send them
+// to an error tracker.
+func WithPanicHook(hook PanicHook) Option {
+	return func(s *Server) {
+		s.PanicHook = hook
+	}
+}
+
+// WithLogger sets where the server reports errors and recovered panics.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+// WithAccessLog writes a line for every answered request to out, in the
+// Common or Combined Log Format or as JSON.
+func WithAccessLog(out io.Writer, format AccessLogFormat) Option {
+	return func(s *Server) {
+		s.AccessLog = newAccessLogger(out, format)
+	}
+}
+
+// WithMetrics reports connections, requests and traffic to recorder.
+func WithMetrics(recorder MetricsRecorder) Option {
+	return func(s *Server) {
+		s.Metrics = recorder
+	}
+}
+
+// WithConnState calls hook every time a connection changes state.
+func WithConnState(hook func(net.Conn, ConnState)) Option {
+	return func(s *Server) {
+		s.ConnState = hook
+	}
+}
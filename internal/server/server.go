@@ -2,118 +2,219 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
 	"github.com/arnicfil/go_learn_http_protocol/internal/request"
 	"github.com/arnicfil/go_learn_http_protocol/internal/response"
 )
 
+const (
+	defaultIdleTimeout        = 60 * time.Second
+	defaultReadHeaderTimeout  = 10 * time.Second
+	defaultMaxRequestsPerConn = 100
+
+	// Bounds of the delay before accepting again after an accept error.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
 type Server struct {
-	Listener    net.Listener
-	Closing     atomic.Bool
-	Wg          sync.WaitGroup
-	HandlerFunc Handler
+	Listener           net.Listener
+	Closing            atomic.Bool
+	Wg                 sync.WaitGroup
+	HandlerFunc        Handler
+	Network            string
+	IdleTimeout        time.Duration
+	ReadHeaderTimeout  time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	HandlerTimeout     time.Duration
+	MaxRequestsPerConn int
+	StreamRequestBody  bool
+	Limits             request.Limits
+	TLSConfig          *tls.Config
+	ErrorRenderer      ErrorRenderer
+	PanicHook          PanicHook
+	Logger             *slog.Logger
+	AccessLog          *slog.Logger
+	Metrics            MetricsRecorder
+	ConnState          func(net.Conn, ConnState)
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
 }
 
-type Handler func(w *response.Writer, req *request.Request) *HandlerError
+type Handler func(w response.ResponseWriter, req *request.Request) *HandlerError
 
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    bytes.Buffer
+	Headers    *headers.Headers
 }
 
 var ERROR_WRITER = errors.New("Error write didn't accept whole message")
 
-func Serve(port int, handlerFunc Handler) (*Server, error) {
-	lsn, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Serve listens on every interface at port and serves h.
+func Serve(port int, handlerFunc Handler, opts ...Option) (*Server, error) {
+	return ListenAndServe(fmt.Sprintf(":%d", port), handlerFunc, opts...)
+}
+
+// ListenAndServe listens on addr, which can name a specific interface, and
+// serves h. The network is "tcp" unless WithNetwork says otherwise.
+func ListenAndServe(addr string, handlerFunc Handler, opts ...Option) (*Server, error) {
+	server := newServer(handlerFunc, opts)
+
+	lsn, err := net.Listen(server.Network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("Error while creating server: %w", err)
 	}
 
+	server.start(lsn)
+	return server, nil
+}
+
+// ServeListener serves h on a listener the caller already has. Listening on
+// port 0 and reading Addr afterwards gives tests a free port without races.
+func ServeListener(lsn net.Listener, handlerFunc Handler, opts ...Option) *Server {
+	server := newServer(handlerFunc, opts)
+	server.start(lsn)
+	return server
+}
+
+func newServer(handlerFunc Handler, opts []Option) *Server {
 	server := &Server{
-		Listener:    lsn,
-		Closing:     atomic.Bool{},
-		HandlerFunc: handlerFunc,
+		Closing:            atomic.Bool{},
+		HandlerFunc:        handlerFunc,
+		Network:            "tcp",
+		IdleTimeout:        defaultIdleTimeout,
+		ReadHeaderTimeout:  defaultReadHeaderTimeout,
+		MaxRequestsPerConn: defaultMaxRequestsPerConn,
+		Limits:             request.DefaultLimits(),
+		Logger:             slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(server)
 	}
 
-	server.Closing.Store(false)
-	go server.listen()
+	return server
+}
 
-	return server, nil
+func (s *Server) start(lsn net.Listener) {
+	s.Listener = s.tlsListener(lsn)
+	s.Closing.Store(false)
+	go s.listen()
 }
 
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.Listener.Addr()
+}
+
+// Close stops accepting connections, closes every open one, including those
+// with requests in flight, and waits for their goroutines to exit. Use
+// Shutdown to let the requests finish.
 func (s *Server) Close() error {
-	s.Closing.Store(true)
-	err := s.Listener.Close()
+	err := s.stopListening()
+	s.closeAllConns()
 	s.Wg.Wait()
 	return err
 }
 
+// listen accepts connections until the listener is closed. Other accept
+// errors, such as running out of file descriptors, usually pass, so they are
+// retried with a growing delay instead of stopping the server.
 func (s *Server) listen() error {
+	var delay time.Duration
 	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
 			if s.Closing.Load() {
 				return nil
 			}
-			return fmt.Errorf("Error while accepting: %w", err)
+			if errors.Is(err, net.ErrClosed) {
+				s.Logger.Error("Listener closed while serving", "err", err)
+				return fmt.Errorf("Error while accepting: %w", err)
+			}
+
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			s.Logger.Error("Error while accepting, retrying", "err", err, "delay", delay)
+			time.Sleep(delay)
+			continue
 		}
+		delay = 0
 
+		c := newConn(s, conn)
+		if !s.trackConn(c) {
+			conn.Close()
+			return nil
+		}
+
+		if s.Metrics != nil {
+			s.Metrics.ConnAccepted()
+		}
 		s.Wg.Add(1)
-		go s.handle(conn)
+		go s.handle(c)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+func (s *Server) handle(c *conn) {
 	defer s.Wg.Done()
-	defer conn.Close()
+	defer s.untrackConn(c)
+	if s.Metrics != nil {
+		defer s.Metrics.ConnClosed()
+	}
 
-	responseWriter := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
+	c.setState(StateNew)
+	err := c.handshake()
 	if err != nil {
-		fmt.Printf("Error while reading from reader: %v", err)
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(response.GetDefaultHeaders(0))
+		s.Logger.Debug("Error while accepting connection", "remote", c.netConn.RemoteAddr(), "err", err)
+		c.close()
 		return
 	}
 
-	herr := s.HandlerFunc(responseWriter, req)
-	if herr != nil {
-		err = handleError(conn, herr)
-		if err != nil {
-			fmt.Printf("Error while returning error: %v", err)
-			return
-		}
-	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		c.writeResponses()
+	}()
 
+	c.readRequests()
+	c.watchForHangUp()
+	<-written
 }
 
-func writeResponse(w io.Writer, statusCode response.StatusCode, buffer *bytes.Buffer) error {
-	responseHeaders := response.GetDefaultHeaders(buffer.Len())
+func writeResponse(w *response.Writer, statusCode response.StatusCode, contentType string, body []byte, extra *headers.Headers) error {
+	responseHeaders := response.GetDefaultHeaders(len(body))
+	responseHeaders.Set("Content-Type", contentType)
+	for key := range extra.All() {
+		responseHeaders.Del(key)
+	}
+	for key, val := range extra.All() {
+		responseHeaders.Add(key, val)
+	}
 
-	err := response.WriteStatusLine(w, statusCode)
+	err := w.WriteStatusLine(statusCode)
 	if err != nil {
 		return fmt.Errorf("Error while writing status line: %w", err)
 	}
 
-	err = response.WriteHeaders(w, responseHeaders)
+	err = w.WriteHeaders(responseHeaders)
 	if err != nil {
 		return fmt.Errorf("Error while writing headers: %w", err)
 	}
 
-	err = response.WriteBody(w, buffer.Bytes())
+	_, err = w.WriteBody(body)
 	if err != nil {
 		return fmt.Errorf("Error while writing body: %w", err)
 	}
 
 	return nil
 }
-
-func handleError(w io.Writer, herr *HandlerError) error {
-	return writeResponse(w, herr.StatusCode, &herr.Message)
-}
@@ -0,0 +1,897 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/arnicfil/go_learn_http_protocol/internal/headers"
+	"github.com/arnicfil/go_learn_http_protocol/internal/request"
+	"github.com/arnicfil/go_learn_http_protocol/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		body := []byte(req.URL.Path)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	s := newTestServer(t, handler, WithLimits(request.Limits{MaxRequestLineSize: 64}))
+
+	// Test: Keep-alive serves several requests on one connection
+	conn := dial(t, s)
+	reader := bufio.NewReader(conn)
+	for _, path := range []string{"/a", "/b"} {
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		status, body := readResponse(t, reader)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, path, body)
+	}
+	conn.Close()
+
+	// Test: HEAD sends the GET headers without the body
+	conn = dial(t, s)
+	reader = bufio.NewReader(conn)
+	conn.Write([]byte("HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	head := ""
+	for !strings.HasSuffix(head, "\r\n\r\n") {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+	}
+	assert.Contains(t, head, "Content-Length: 5\r\n")
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "/next", body)
+	conn.Close()
+
+	// Test: Request line over the limit
+	conn = dial(t, s)
+	conn.Write([]byte("GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n"))
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 414 URI Too Long", status)
+	conn.Close()
+}
+
+func TestKeepAlive(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		body := []byte(req.URL.Path)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	s := newTestServer(t, handler)
+
+	// Test: Two requests on one connection, the second asking to close
+	conn := dial(t, s)
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, body := readResponse(t, reader)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "/first", body)
+	conn.Write([]byte("GET /second HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\n/second"))
+	conn.Close()
+
+	// Test: HTTP/1.1 keeps the connection open by default
+	conn = dial(t, s)
+	reader = bufio.NewReader(conn)
+	conn.Write([]byte("GET /open HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	head := ""
+	for !strings.HasSuffix(head, "\r\n\r\n") {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+	}
+	assert.Contains(t, head, "Connection: keep-alive\r\n")
+	conn.Close()
+
+	// Test: HTTP/1.0 closes by default
+	conn = dial(t, s)
+	conn.Write([]byte("GET /old HTTP/1.0\r\nHost: localhost\r\n\r\nGET /ignored HTTP/1.0\r\n\r\n"))
+	rest, _ = io.ReadAll(conn)
+	assert.Contains(t, string(rest), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\n/old"))
+	conn.Close()
+
+	// Test: HTTP/1.0 can ask for keep-alive
+	conn = dial(t, s)
+	reader = bufio.NewReader(conn)
+	for _, path := range []string{"/a", "/b"} {
+		conn.Write([]byte("GET " + path + " HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+		status, body = readResponse(t, reader)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, path, body)
+	}
+	conn.Close()
+
+	// Test: HTTP/1.0 with a chunked body closes even when asked to keep alive
+	conn = dial(t, s)
+	conn.Write([]byte("POST /chunked HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\nGET /ignored HTTP/1.0\r\n\r\n"))
+	rest, _ = io.ReadAll(conn)
+	assert.Contains(t, string(rest), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\n/chunked"))
+	conn.Close()
+}
+
+func TestPipelining(t *testing.T) {
+	release := make(chan struct{})
+	var bigWritten atomic.Int64
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		switch req.URL.Path {
+		case "/slow":
+			<-release
+		case "/big":
+			chunk := bytes.Repeat([]byte("x"), 4<<10)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(256 * len(chunk)))
+			for range 256 {
+				if _, err := w.WriteBody(chunk); err != nil {
+					return nil
+				}
+				bigWritten.Add(int64(len(chunk)))
+			}
+			return nil
+		}
+
+		body := []byte(req.URL.Path)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	s := newTestServer(t, handler)
+
+	// Test: Responses go out in request order, not in the order handlers finish
+	conn := dial(t, s)
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /big HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /last HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	// Test: A large response behind a slow one is stalled, not buffered whole
+	assert.Eventually(t, func() bool { return bigWritten.Load() > 0 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Less(t, bigWritten.Load(), int64(1<<20))
+
+	close(release)
+	for _, want := range []string{"/slow", "/fast"} {
+		status, body := readResponse(t, reader)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, want, body)
+	}
+	_, body := readResponse(t, reader)
+	assert.Equal(t, 1<<20, len(body))
+	assert.Equal(t, int64(1<<20), bigWritten.Load())
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "/last", body)
+	conn.Close()
+}
+
+func TestErrorRenderer(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		return &HandlerError{StatusCode: response.StatusConflict, Message: *bytes.NewBufferString("short and stout")}
+	}
+	renderer := func(req *request.Request, statusCode response.StatusCode, err error) (string, []byte) {
+		path := "-"
+		if req != nil {
+			path = req.URL.Path
+		}
+		return "application/problem+json", fmt.Appendf(nil, `{"status":%d,"path":%q,"detail":%q}`, statusCode, path, err.Error())
+	}
+	s := newTestServer(t, handler, WithErrorRenderer(renderer))
+
+	// Test: Handler error rendered by the custom renderer
+	conn := dial(t, s)
+	conn.Write([]byte("GET /pot HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 409 Conflict\r\n"))
+	assert.Contains(t, string(out), "Content-Type: application/problem+json\r\n")
+	assert.True(t, strings.HasSuffix(string(out), `{"status":409,"path":"/pot","detail":"Handler error 409: short and stout"}`))
+	conn.Close()
+
+	// Test: Parse error rendered without a request
+	conn = dial(t, s)
+	conn.Write([]byte("GET / HTTP/2.0\r\n\r\n"))
+	status, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 505 HTTP Version Not Supported", status)
+	assert.True(t, strings.HasPrefix(body, `{"status":505,"path":"-","detail":`))
+	conn.Close()
+}
+
+func TestPanicRecovery(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		if req.URL.Path == "/late" {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.WriteBody([]byte("half"))
+		}
+		panic("boom " + req.URL.Path)
+	}
+	type panicked struct {
+		path      string
+		recovered any
+		stack     string
+	}
+	panics := make(chan panicked, 2)
+	hook := func(req *request.Request, recovered any, stack []byte) {
+		panics <- panicked{req.URL.Path, recovered, string(stack)}
+	}
+	s := newTestServer(t, handler, WithPanicHook(hook))
+
+	// Test: Panic before writing becomes a 500 and reaches the hook
+	conn := dial(t, s)
+	conn.Write([]byte("GET /early HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", status)
+	conn.Close()
+	p := <-panics
+	assert.Equal(t, "/early", p.path)
+	assert.Equal(t, "boom /early", p.recovered)
+	assert.Contains(t, p.stack, "panic")
+
+	// Test: Panic after the status line cuts the connection instead
+	conn = dial(t, s)
+	conn.Write([]byte("GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nhalf"))
+	assert.NotContains(t, string(out), "500")
+	conn.Close()
+	p = <-panics
+	assert.Equal(t, "/late", p.path)
+}
+
+// flakyListener fails its first accepts the way a listener out of file
+// descriptors does.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestListen(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+	logger := WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Test: ListenAndServe binds the given address and network
+	s, err := ListenAndServe("127.0.0.1:0", handler, WithNetwork("tcp4"), logger)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	addr, ok := s.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	assert.Equal(t, "127.0.0.1", addr.IP.String())
+	assert.NotZero(t, addr.Port)
+	conn := dial(t, s)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	conn.Close()
+
+	// Test: Address the network can't bind
+	_, err = ListenAndServe("[::1]:0", handler, WithNetwork("tcp4"), logger)
+	require.Error(t, err)
+
+	// Test: Accept errors are retried rather than ending the accept loop
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: lsn}
+	flaky.failures.Store(3)
+	s = ServeListener(flaky, handler, logger)
+	t.Cleanup(func() { s.Close() })
+	conn = dial(t, s)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.LessOrEqual(t, flaky.failures.Load(), int32(-1))
+	conn.Close()
+}
+
+func TestServerTimeouts(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		return nil
+	}
+	s := newTestServer(t, handler, WithReadHeaderTimeout(50*time.Millisecond))
+
+	// Test: Headers not finished in time
+	conn := dial(t, s)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: local"))
+	status, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", status)
+	conn.Close()
+
+	// Test: Body not finished within the read timeout
+	s = newTestServer(t, handler, WithReadTimeout(50*time.Millisecond))
+	conn = dial(t, s)
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	start := time.Now()
+	status, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", status)
+	assert.Less(t, time.Since(start), time.Second)
+	conn.Close()
+
+	// Test: Idle keep-alive connection closed quietly
+	answer := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+	s = newTestServer(t, answer, WithIdleTimeout(50*time.Millisecond))
+	conn = dial(t, s)
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, _ = readResponse(t, reader)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	start = time.Now()
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Less(t, time.Since(start), time.Second)
+	conn.Close()
+
+	// Test: Client that stops reading trips the write timeout
+	writeErr := make(chan error, 1)
+	flood := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		chunk := make([]byte, 64<<10)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(1 << 30))
+		for {
+			if _, err := w.WriteBody(chunk); err != nil {
+				writeErr <- err
+				return nil
+			}
+		}
+	}
+	s = newTestServer(t, flood, WithWriteTimeout(100*time.Millisecond))
+	conn = dial(t, s)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	select {
+	case err := <-writeErr:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a stalled client never timed out")
+	}
+	conn.Close()
+}
+
+func TestServerConnState(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	hook := func(c net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}
+	lastState := func(want ConnState) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(states) > 0 && states[len(states)-1] == want
+		}
+	}
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+	s := newTestServer(t, handler, WithConnState(hook))
+
+	conn := dial(t, s)
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	readResponse(t, reader)
+	require.Eventually(t, lastState(StateIdle), time.Second, 10*time.Millisecond)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	readResponse(t, reader)
+	_, err := reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	require.Eventually(t, lastState(StateClosed), time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateIdle, StateActive, StateClosed}, states)
+}
+
+func newTestServer(t *testing.T, handler Handler, opts ...Option) *Server {
+	t.Helper()
+
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	opts = append(opts, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	s := ServeListener(lsn, handler, opts...)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func dial(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+// readResponse reads one response framed by Content-Length and returns its
+// status line and body.
+func readResponse(t *testing.T, reader *bufio.Reader) (string, string) {
+	t.Helper()
+
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+
+	contentLength := 0
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		key, val, _ := strings.Cut(line, ":")
+		if strings.EqualFold(key, "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(val))
+			require.NoError(t, err)
+		}
+	}
+
+	body := make([]byte, contentLength)
+	_, err = io.ReadFull(reader, body)
+	require.NoError(t, err)
+
+	return strings.TrimRight(status, "\r\n"), string(body)
+}
+
+func TestServerShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		if req.URL.Path == "/block" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+
+	// Test: Idle connections close, in-flight requests finish
+	s := newTestServer(t, handler)
+	idle := dial(t, s)
+	idleReader := bufio.NewReader(idle)
+	idle.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	readResponse(t, idleReader)
+
+	busy := dial(t, s)
+	busy.Write([]byte("GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-started
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	_, err := idleReader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	close(release)
+	status, _ := readResponse(t, bufio.NewReader(busy))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	require.NoError(t, <-done)
+
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+
+	// Test: Close after Shutdown doesn't close the listener twice
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+
+	// Test: Context ends with a request still running
+	release = make(chan struct{})
+	defer close(release)
+	s = newTestServer(t, handler)
+	busy = dial(t, s)
+	busy.Write([]byte("GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	var serr *ShutdownError
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, 1, serr.Forced)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	started := make(chan struct{}, 1)
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		started <- struct{}{}
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+		return nil
+	}
+	s := newTestServer(t, handler, WithHandlerTimeout(time.Second))
+
+	// Test: Client hangs up mid-request
+	for _, opts := range [][]Option{nil, {WithStreamingBody()}} {
+		srv := newTestServer(t, handler, append(opts, WithHandlerTimeout(time.Second))...)
+		for _, connection := range []string{"keep-alive", "close"} {
+			conn := dial(t, srv)
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: " + connection + "\r\n\r\n"))
+			<-started
+			conn.Close()
+			select {
+			case err := <-cancelled:
+				assert.Equal(t, context.Canceled, err)
+			case <-time.After(500 * time.Millisecond):
+				t.Fatalf("context not cancelled after hang-up, connection %s, streaming %v", connection, len(opts) > 0)
+			}
+		}
+	}
+
+	// Test: Streaming body still on the wire keeps the hang-up unnoticed
+	streaming := newTestServer(t, handler, WithStreamingBody(), WithHandlerTimeout(100*time.Millisecond))
+	conn := dial(t, streaming)
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n"))
+	<-started
+	conn.Close()
+	assert.Equal(t, context.DeadlineExceeded, <-cancelled)
+
+	// Test: Handler timeout
+	conn = dial(t, s)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-started
+	assert.Equal(t, context.DeadlineExceeded, <-cancelled)
+	conn.Close()
+
+	// Test: Server closed
+	conn = dial(t, s)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-started
+	s.Close()
+	assert.Equal(t, context.Canceled, <-cancelled)
+	conn.Close()
+}
+
+func TestServerTLS(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		body := []byte(req.TLS.NegotiatedProtocol)
+		if len(req.TLS.PeerCertificates) > 0 {
+			body = append(body, " "+req.TLS.PeerCertificates[0].Subject.CommonName...)
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	serverCert, err := SelfSignedCert("127.0.0.1")
+	require.NoError(t, err)
+	clientCert, err := SelfSignedCert("client")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	// Test: ALPN negotiates http/1.1
+	s := newTestServer(t, handler, WithCertificate(serverCert))
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	status, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "http/1.1", body)
+	conn.Close()
+
+	// Test: Client certificate required
+	s = newTestServer(t, handler, WithCertificate(serverCert), WithClientCAs(clientCAs))
+	conn, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.Error(t, err)
+	conn.Close()
+
+	// Test: Client certificate exposed on the request
+	conn, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	_, body = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "http/1.1 go_learn_http_protocol self-signed", body)
+	conn.Close()
+}
+
+func TestAccessLog(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		body := []byte("hello")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	raw := "GET /a?b=c HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test/1.0\r\nReferer: http://example.com/\r\n\r\n"
+
+	tests := []struct {
+		format AccessLogFormat
+		want   string
+	}{
+		{AccessLogCommon, `^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=c HTTP/1\.1" 200 5\n$`},
+		{AccessLogCombined, `^127\.0\.0\.1 - - \[.+\] "GET /a\?b=c HTTP/1\.1" 200 5 "http://example\.com/" "test/1\.0"\n$`},
+		{AccessLogJSON, `^\{"time":".+","level":"INFO","msg":"request","remote_addr":"127\.0\.0\.1:\d+","method":"GET","target":"/a\?b=c","proto":"HTTP/1\.1","status":200,"bytes":5,"duration":\d+,"user_agent":"test/1\.0","referer":"http://example\.com/"\}\n$`},
+	}
+	for _, tc := range tests {
+		out := &lockedBuffer{}
+		s := newTestServer(t, handler, WithAccessLog(out, tc.format))
+
+		conn := dial(t, s)
+		conn.Write([]byte(raw))
+		readResponse(t, bufio.NewReader(conn))
+		conn.Close()
+
+		require.Eventually(t, func() bool { return out.String() != "" }, time.Second, 10*time.Millisecond)
+		assert.Regexp(t, tc.want, out.String())
+	}
+
+	// Test: Unreadable request
+	out := &lockedBuffer{}
+	s := newTestServer(t, handler, WithAccessLog(out, AccessLogCommon))
+	conn := dial(t, s)
+	conn.Write([]byte("GET\r\n\r\n"))
+	readResponse(t, bufio.NewReader(conn))
+	conn.Close()
+
+	require.Eventually(t, func() bool { return out.String() != "" }, time.Second, 10*time.Millisecond)
+	assert.Regexp(t, `^127\.0\.0\.1 - - \[.+\] "-" 400 -\n$`, out.String())
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestExpectContinue(t *testing.T) {
+	echo := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		if req.URL.Path == "/reject" {
+			return &HandlerError{StatusCode: response.StatusExpectationFailed}
+		}
+
+		body, err := io.ReadAll(req.BodyReader)
+		if err != nil {
+			return &HandlerError{StatusCode: response.StatusBadRequest}
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	headers := "Host: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+
+	for _, opts := range [][]Option{nil, {WithStreamingBody()}} {
+		s := newTestServer(t, echo, append(opts, WithLimits(request.Limits{MaxBodySize: 10}))...)
+
+		// Test: 100 Continue before the body is sent
+		conn := dial(t, s)
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("POST /echo HTTP/1.1\r\n" + headers))
+		interim, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 100 Continue\r\n", interim)
+		blank, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "\r\n", blank)
+		conn.Write([]byte("hello"))
+		status, body := readResponse(t, reader)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "hello", body)
+		conn.Close()
+
+		// Test: Unknown expectation
+		conn = dial(t, s)
+		conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nExpect: teapot\r\nContent-Length: 5\r\n\r\n"))
+		status, _ = readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "HTTP/1.1 417 Expectation Failed", status)
+		conn.Close()
+
+		// Test: Body over the limit is refused without asking for it
+		conn = dial(t, s)
+		conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 50\r\n\r\n"))
+		rest, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 413 Content Too Large\r\n"))
+		assert.NotContains(t, string(rest), "100 Continue")
+		conn.Close()
+
+		// Test: No 1xx for an HTTP/1.0 client, which sends the body anyway
+		conn = dial(t, s)
+		reader = bufio.NewReader(conn)
+		conn.Write([]byte("POST /echo HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+		time.Sleep(20 * time.Millisecond)
+		conn.Write([]byte("hello"))
+		status, body = readResponse(t, reader)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "hello", body)
+		conn.Close()
+
+		// Test: Body sent along without waiting isn't asked for again
+		conn = dial(t, s)
+		reader = bufio.NewReader(conn)
+		conn.Write([]byte("POST /echo HTTP/1.1\r\n" + headers + "hello"))
+		status, body = readResponse(t, reader)
+		if status == "HTTP/1.1 100 Continue" {
+			status, body = readResponse(t, reader)
+		}
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "hello", body)
+		conn.Close()
+	}
+
+	// Test: Handler rejects before reading the body
+	s := newTestServer(t, echo, WithStreamingBody())
+	conn := dial(t, s)
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("POST /reject HTTP/1.1\r\n" + headers))
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed\r\n", status)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "Connection: close\r\n")
+	conn.Close()
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		body := []byte(req.URL.Path)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	payloads := []struct {
+		headers string
+		status  string
+	}{
+		{"Content-Length: 6\r\nTransfer-Encoding: chunked\r\n", "HTTP/1.1 400 Bad Request"},
+		{"Content-Length: 5\r\nContent-Length: 6\r\n", "HTTP/1.1 400 Bad Request"},
+		{"Transfer-Encoding: chunked, identity\r\n", "HTTP/1.1 400 Bad Request"},
+		{"Transfer-Encoding: gzip, chunked\r\n", "HTTP/1.1 501 Not Implemented"},
+		{" Transfer-Encoding: chunked\r\n", "HTTP/1.1 400 Bad Request"},
+	}
+
+	for _, opts := range [][]Option{nil, {WithStreamingBody()}} {
+		s := newTestServer(t, handler, opts...)
+
+		for _, payload := range payloads {
+			// Test: Ambiguous framing is refused and the rest of the connection dropped
+			conn := dial(t, s)
+			reader := bufio.NewReader(conn)
+			conn.Write([]byte("POST / HTTP/1.1\r\n" + payload.headers + "Host: localhost\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			status, _ := readResponse(t, reader)
+			assert.Equal(t, payload.status, status, payload.headers)
+			// The unread body makes the close a reset, so only the content counts.
+			rest, _ := io.ReadAll(reader)
+			assert.NotContains(t, string(rest), "/smuggled", payload.headers)
+			conn.Close()
+		}
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	handler := func(w response.ResponseWriter, req *request.Request) *HandlerError {
+		if req.URL.Path == "/missing" {
+			return &HandlerError{StatusCode: response.StatusNotFound, Message: *bytes.NewBufferString("no <such> page")}
+		}
+		if req.URL.Path == "/localized" {
+			hdrs := headers.NewHeaders()
+			hdrs.Set("Vary", "Accept-Language")
+			return &HandlerError{StatusCode: response.StatusNotFound, Headers: hdrs}
+		}
+
+		contentType, herr := Negotiate(req, "text/html", "application/json")
+		if herr != nil {
+			return herr
+		}
+		body := []byte(contentType)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	s := newTestServer(t, handler)
+	conn := dial(t, s)
+	reader := bufio.NewReader(conn)
+	get := func(path string, accept string) (string, string) {
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\nAccept: " + accept + "\r\n\r\n"))
+		return readResponse(t, reader)
+	}
+
+	// Test: Handler picks the preferred offer
+	status, body := get("/", "application/json, text/html;q=0.9")
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "application/json", body)
+
+	// Test: Nothing acceptable is a 406
+	status, body = get("/", "image/png")
+	assert.Equal(t, "HTTP/1.1 406 Not Acceptable", status)
+	assert.Equal(t, "Available: text/html, application/json", body)
+
+	// Test: Error page as JSON
+	status, body = get("/missing", "application/json")
+	assert.Equal(t, "HTTP/1.1 404 Not Found", status)
+	assert.Equal(t, `{"status":404,"error":"Not Found","message":"no \u003csuch\u003e page"}`, body)
+
+	// Test: Error page as HTML
+	_, body = get("/missing", "text/html")
+	assert.Contains(t, body, "<title>404 Not Found</title>")
+	assert.Contains(t, body, "<p>no &lt;such&gt; page</p>")
+
+	// Test: The handler's Vary is merged with the error page's
+	other := dial(t, s)
+	other.Write([]byte("GET /localized HTTP/1.1\r\nHost: localhost\r\nAccept: text/html\r\nConnection: close\r\n\r\n"))
+	rest, err := io.ReadAll(other)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, string(rest), "Vary: Accept-Language, Accept\r\n")
+	assert.Equal(t, 1, strings.Count(string(rest), "Vary:"))
+	other.Close()
+
+	// Test: Error page as plain text, with Vary
+	conn.Write([]byte("GET /missing HTTP/1.1\r\nHost: localhost\r\nAccept: */*\r\nConnection: close\r\n\r\n"))
+	rest, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "Content-Type: text/plain\r\n")
+	assert.Contains(t, string(rest), "Vary: Accept\r\n")
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nno <such> page"))
+}
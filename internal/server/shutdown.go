@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown looks for connections that went
+// idle and checks whether every connection is gone.
+const shutdownPollInterval = 20 * time.Millisecond
+
+// ShutdownError is returned by Shutdown when the context ended before every
+// connection finished on its own.
+type ShutdownError struct {
+	// Forced is the number of connections that were closed mid-request.
+	Forced int
+	Err    error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("Error shutting down, %d connections forced closed: %v", e.Forced, e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Shutdown stops accepting connections and closes idle ones right away.
+// Connections with requests in flight get to finish them and are closed once
+// they go idle. When ctx ends first, the remaining connections are closed and
+// a *ShutdownError wrapping ctx.Err() says how many.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			s.Wg.Wait()
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &ShutdownError{
+				Forced: s.closeAllConns(),
+				Err:    ctx.Err(),
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopListening closes the listener the first time it is called, so Close
+// after Shutdown doesn't report the listener as already closed.
+func (s *Server) stopListening() error {
+	s.mu.Lock()
+	wasClosing := s.Closing.Swap(true)
+	s.mu.Unlock()
+
+	if wasClosing {
+		return nil
+	}
+	return s.Listener.Close()
+}
+
+// trackConn registers c so shutdown can find it, unless the server is
+// already closing.
+func (s *Server) trackConn(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Closing.Load() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrackConn(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+}
+
+// closeIdleConns closes every connection that isn't serving a request and
+// reports whether no connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.closeIfIdle()
+	}
+
+	return len(s.conns) == 0
+}
+
+// closeAllConns closes every connection, busy or not, and returns how many
+// were still open.
+func (s *Server) closeAllConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	closed := 0
+	for c := range s.conns {
+		if !c.closed.Load() {
+			closed++
+		}
+		c.close()
+	}
+
+	return closed
+}
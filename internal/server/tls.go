@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"time"
+)
+
+// alpnProtocol is the only protocol this server speaks, offered through ALPN.
+const alpnProtocol = "http/1.1"
+
+// ListenAndServeTLS is ListenAndServe over TLS, with the certificate and key
+// loaded from PEM files.
+func ListenAndServeTLS(addr string, certFile string, keyFile string, handlerFunc Handler, opts ...Option) (*Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error while loading certificate: %w", err)
+	}
+
+	return ListenAndServe(addr, handlerFunc, append(opts, WithCertificate(cert))...)
+}
+
+// tlsListener wraps lsn so every connection is served over TLS, if the
+// server was given a TLS configuration.
+func (s *Server) tlsListener(lsn net.Listener) net.Listener {
+	if s.TLSConfig == nil {
+		return lsn
+	}
+
+	cfg := s.TLSConfig.Clone()
+	if !slices.Contains(cfg.NextProtos, alpnProtocol) {
+		cfg.NextProtos = append(cfg.NextProtos, alpnProtocol)
+	}
+
+	return tls.NewListener(lsn, cfg)
+}
+
+// handshake completes the TLS handshake, if any, within the header timeout so
+// a client can't hold the connection open without ever sending a request.
+func (c *conn) handshake() error {
+	tlsConn, ok := c.netConn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	s := c.server
+	c.netConn.SetDeadline(deadline(time.Now(), firstPositive(s.ReadHeaderTimeout, s.ReadTimeout)))
+	err := tlsConn.HandshakeContext(c.ctx)
+	if err != nil {
+		return fmt.Errorf("Error during TLS handshake: %w", err)
+	}
+	c.netConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	c.tlsState = &state
+	return nil
+}
+
+// SelfSignedCert generates a certificate for hosts, which may be host names
+// or IP addresses, signed by its own key. It is meant for local development
+// and tests: clients have to trust its Leaf explicitly.
+func SelfSignedCert(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error while generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error while generating serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go_learn_http_protocol self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error while creating certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error while parsing certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}